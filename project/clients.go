@@ -1,17 +1,23 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
 	"net/http"
 
-	"github.com/gofrs/uuid/v5"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Gateway paths called by EmailSender and CRMClient, relative to the gateway address.
+const (
+	EmailSendPath    = "/emails-api/email/send"
+	CRMUsersPath     = "/crm-api/crm/users"
+	CRMUsersBulkPath = "/crm-api/crm/users/bulk"
 )
 
 type EmailSender struct {
 	ApiEndpoint string
+	Client      *GatewayClient
 }
 
 type SendEmailRequest struct {
@@ -20,72 +26,25 @@ type SendEmailRequest struct {
 	Body    string
 }
 
-func (e EmailSender) SendEmail(ctx context.Context, email string, subject string, body string) error {
-	jsonBody, err := json.Marshal(SendEmailRequest{
-		Email:   email,
-		Subject: subject,
-		Body:    body,
+// SendEmail returns a GatewayError, see IsRetryable.
+// The gateway only accepts plain text, so the HTML body isn't sent.
+func (e EmailSender) SendEmail(ctx context.Context, email Email) (err error) {
+	ctx, span := tracer().Start(ctx, "EmailSender.SendEmail", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		observeGatewayCall("email", err)
+		endSpan(span, err)
+	}()
+
+	return e.Client.PostJSON(ctx, e.ApiEndpoint, SendEmailRequest{
+		Email:   email.To,
+		Subject: email.Subject,
+		Body:    email.TextBody,
 	})
-	if err != nil {
-		return fmt.Errorf("failed to marshal SendEmailRequest: %w", err)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.ApiEndpoint, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
-	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send email: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to send email, status code: %d", resp.StatusCode)
-	}
-
-	return nil
 }
 
-type CRMClient struct {
-	ApiEndpoint string
-}
-
-type SendUserToCRMRequest struct {
-	UserID uuid.UUID `json:"user_id"`
-	Name   string    `json:"name"`
-	Email  string    `json:"email"`
-}
-
-func (c CRMClient) SendUserToCRM(ctx context.Context, userID uuid.UUID, name string, email string) error {
-	jsonBody, err := json.Marshal(SendUserToCRMRequest{
-		UserID: userID,
-		Name:   name,
-		Email:  email,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to marshal SendUserToCRMRequest: %w", err)
-	}
-
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.ApiEndpoint, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+// setCorrelationIDHeader passes the correlation ID to the gateway, so its logs can be matched with ours.
+func setCorrelationIDHeader(ctx context.Context, req *http.Request) {
+	if correlationID := CorrelationIDFromContext(ctx); correlationID != "" {
+		req.Header.Set(echo.HeaderXRequestID, correlationID)
 	}
-
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return fmt.Errorf("failed to send user to CRM: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to send user to CRM, status code: %d", resp.StatusCode)
-	}
-
-	return nil
 }
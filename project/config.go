@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFileEnv points to an optional YAML config file. Environment variables override values from the file.
+const ConfigFileEnv = "CONFIG_FILE"
+
+type Config struct {
+	PostgresURL string        `yaml:"postgres_url"`
+	LogLevel    slog.Level    `yaml:"log_level"`
+	HTTP        HTTPConfig    `yaml:"http"`
+	Gateway     GatewayConfig `yaml:"gateway"`
+	PubSub      PubSubConfig  `yaml:"pubsub"`
+	Email       EmailConfig   `yaml:"email"`
+
+	EmailConfirmation EmailConfirmationConfig `yaml:"email_confirmation"`
+	ProcessedMessages ProcessedMessagesConfig `yaml:"processed_messages"`
+
+	Retry         HandlerRetryConfigs `yaml:"retry"`
+	OutboxMonitor OutboxMonitorConfig `yaml:"outbox_monitor"`
+	OutboxCleaner OutboxCleanerConfig `yaml:"outbox_cleaner"`
+	Shutdown      ShutdownConfig      `yaml:"shutdown"`
+}
+
+type HTTPConfig struct {
+	Port         int           `yaml:"port"`
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+
+	IdempotencyKeyTTL time.Duration `yaml:"idempotency_key_ttl"`
+
+	// AdminToken is the bearer token of the /admin API. The API is disabled without it.
+	AdminToken string `yaml:"admin_token"`
+}
+
+func (c HTTPConfig) Addr() string {
+	return ":" + strconv.Itoa(c.Port)
+}
+
+type GatewayConfig struct {
+	Addr string `yaml:"addr"`
+
+	Email    GatewayClientConfig `yaml:"email"`
+	CRM      GatewayClientConfig `yaml:"crm"`
+	CRMBatch CRMBatchConfig      `yaml:"crm_batch"`
+}
+
+type PubSubConfig struct {
+	Backend      PubSubBackend `yaml:"backend"`
+	KafkaBrokers []string      `yaml:"kafka_brokers"`
+
+	// ConsumerGroupPrefix is prepended to every consumer group,
+	// so several environments can share one broker.
+	ConsumerGroupPrefix string `yaml:"consumer_group_prefix"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		LogLevel: slog.LevelDebug,
+		HTTP: HTTPConfig{
+			Port:              8080,
+			ReadTimeout:       10 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdempotencyKeyTTL: DefaultIdempotencyKeyTTL,
+		},
+		Gateway: GatewayConfig{
+			Email:    DefaultGatewayClientConfig(),
+			CRM:      DefaultGatewayClientConfig(),
+			CRMBatch: DefaultCRMBatchConfig(),
+		},
+		PubSub: PubSubConfig{
+			Backend: PubSubBackendKafka,
+		},
+		Email:             DefaultEmailConfig(),
+		EmailConfirmation: DefaultEmailConfirmationConfig(),
+		Retry:             DefaultHandlerRetryConfigs(),
+		ProcessedMessages: DefaultProcessedMessagesConfig(),
+		OutboxMonitor:     DefaultOutboxMonitorConfig(),
+		OutboxCleaner:     DefaultOutboxCleanerConfig(),
+		Shutdown:          DefaultShutdownConfig(),
+	}
+}
+
+// LoadConfig reads the config from defaults, the YAML file from CONFIG_FILE and environment variables,
+// in that order. All missing and invalid values are reported together.
+func LoadConfig() (Config, error) {
+	return loadConfig(Config.Validate)
+}
+
+// LoadMigrateConfig reads the config like LoadConfig, but only validates what the migrate command uses,
+// so migrations can run before the rest of the service is configured.
+func LoadMigrateConfig() (Config, error) {
+	return loadConfig(Config.ValidateDB)
+}
+
+func loadConfig(validate func(Config) error) (Config, error) {
+	cfg := DefaultConfig()
+
+	if path := os.Getenv(ConfigFileEnv); path != "" {
+		if err := loadConfigFile(path, &cfg); err != nil {
+			return Config{}, err
+		}
+	}
+
+	env := envLoader{}
+	env.String("POSTGRES_URL", &cfg.PostgresURL)
+	env.Text("LOG_LEVEL", &cfg.LogLevel)
+	env.Int("HTTP_PORT", &cfg.HTTP.Port)
+	env.Duration("HTTP_READ_TIMEOUT", &cfg.HTTP.ReadTimeout)
+	env.Duration("HTTP_WRITE_TIMEOUT", &cfg.HTTP.WriteTimeout)
+	env.Duration("IDEMPOTENCY_KEY_TTL", &cfg.HTTP.IdempotencyKeyTTL)
+	env.String("ADMIN_TOKEN", &cfg.HTTP.AdminToken)
+	env.String("GATEWAY_ADDR", &cfg.Gateway.Addr)
+	env.Duration("GATEWAY_TIMEOUT", &cfg.Gateway.Email.Timeout)
+	env.Duration("GATEWAY_TIMEOUT", &cfg.Gateway.CRM.Timeout)
+	env.Bool("CRM_BATCH_ENABLED", &cfg.Gateway.CRMBatch.Enabled)
+	env.String("PUBSUB_BACKEND", (*string)(&cfg.PubSub.Backend))
+	env.List("KAFKA_ADDR", &cfg.PubSub.KafkaBrokers)
+	env.String("CONSUMER_GROUP_PREFIX", &cfg.PubSub.ConsumerGroupPrefix)
+	env.String("EMAIL_PROVIDER", (*string)(&cfg.Email.Provider))
+	env.String("EMAIL_FROM", &cfg.Email.From)
+	env.String("EMAIL_DIR", &cfg.Email.Dir)
+	env.String("SMTP_ADDR", &cfg.Email.SMTP.Addr)
+	env.String("SMTP_USERNAME", &cfg.Email.SMTP.Username)
+	env.String("SMTP_PASSWORD", &cfg.Email.SMTP.Password)
+	env.Bool("SMTP_REQUIRE_TLS", &cfg.Email.SMTP.RequireTLS)
+	env.String("EMAIL_CONFIRMATION_SIGNING_KEY", &cfg.EmailConfirmation.SigningKey)
+	env.String("PUBLIC_BASE_URL", &cfg.EmailConfirmation.BaseURL)
+
+	if err := errors.Join(append(env.errs, validate(cfg))...); err != nil {
+		return Config{}, fmt.Errorf("invalid config:\n%w", err)
+	}
+
+	return cfg, nil
+}
+
+func loadConfigFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Validate returns every invalid value, not only the first one.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	if err := c.ValidateDB(); err != nil {
+		errs = append(errs, err)
+	}
+
+	check(c.HTTP.Port > 0 && c.HTTP.Port <= 65535, "http.port (HTTP_PORT) must be between 1 and 65535, got %d", c.HTTP.Port)
+	check(c.HTTP.ReadTimeout > 0, "http.read_timeout (HTTP_READ_TIMEOUT) must be positive")
+	check(c.HTTP.WriteTimeout > 0, "http.write_timeout (HTTP_WRITE_TIMEOUT) must be positive")
+	check(c.HTTP.IdempotencyKeyTTL > 0, "http.idempotency_key_ttl (IDEMPOTENCY_KEY_TTL) must be positive")
+	check(c.HTTP.AdminToken == "" || len(c.HTTP.AdminToken) >= minAdminTokenLength,
+		"http.admin_token (ADMIN_TOKEN) must be at least %d bytes long", minAdminTokenLength)
+
+	if c.Gateway.Addr == "" {
+		check(false, "gateway.addr (GATEWAY_ADDR) is required")
+	} else {
+		u, err := url.Parse(c.Gateway.Addr)
+		check(err == nil && u.Scheme != "" && u.Host != "", "gateway.addr (GATEWAY_ADDR) must be an absolute URL, got %q", c.Gateway.Addr)
+	}
+	checkGatewayClient := func(name string, clientConfig GatewayClientConfig) {
+		check(clientConfig.Timeout > 0, "gateway.%s.timeout (GATEWAY_TIMEOUT) must be positive", name)
+		check(clientConfig.MaxRetries >= 0, "gateway.%s.max_retries must not be negative", name)
+		check(clientConfig.InitialBackoff > 0, "gateway.%s.initial_backoff must be positive", name)
+		check(clientConfig.MaxBackoff >= clientConfig.InitialBackoff, "gateway.%s.max_backoff must not be shorter than initial_backoff", name)
+		check(clientConfig.BreakerFailures > 0, "gateway.%s.breaker_failures must be positive", name)
+		check(clientConfig.BreakerOpenTimeout > 0, "gateway.%s.breaker_open_timeout must be positive", name)
+	}
+	checkGatewayClient("email", c.Gateway.Email)
+	checkGatewayClient("crm", c.Gateway.CRM)
+	// Queued users are sent even with batching disabled, so the batch config is always checked.
+	check(c.Gateway.CRMBatch.MaxSize > 0, "gateway.crm_batch.max_size must be positive")
+	check(c.Gateway.CRMBatch.Window > 0, "gateway.crm_batch.window must be positive")
+	check(c.Gateway.CRMBatch.Lease > 0, "gateway.crm_batch.lease must be positive")
+	check(c.Gateway.CRMBatch.Retry.MaxRetries >= 0, "gateway.crm_batch.retry.max_retries must not be negative")
+	check(c.Gateway.CRMBatch.Retry.InitialInterval > 0, "gateway.crm_batch.retry.initial_interval must be positive")
+	check(c.Gateway.CRMBatch.Retry.MaxInterval >= c.Gateway.CRMBatch.Retry.InitialInterval,
+		"gateway.crm_batch.retry.max_interval must not be shorter than initial_interval")
+
+	switch c.PubSub.Backend {
+	case PubSubBackendKafka:
+		check(len(c.PubSub.KafkaBrokers) > 0, "pubsub.kafka_brokers (KAFKA_ADDR) is required for the kafka backend")
+		for _, broker := range c.PubSub.KafkaBrokers {
+			check(broker != "", "pubsub.kafka_brokers (KAFKA_ADDR) must not contain empty addresses")
+		}
+	case PubSubBackendGoChannel, PubSubBackendSQL:
+	default:
+		check(false, "pubsub.backend (PUBSUB_BACKEND) must be one of %s, %s, %s, got %q",
+			PubSubBackendKafka, PubSubBackendGoChannel, PubSubBackendSQL, c.PubSub.Backend)
+	}
+
+	switch c.Email.Provider {
+	case EmailProviderGateway:
+	case EmailProviderSMTP:
+		_, _, err := net.SplitHostPort(c.Email.SMTP.Addr)
+		check(err == nil, "email.smtp.addr (SMTP_ADDR) must be host:port, got %q", c.Email.SMTP.Addr)
+		check(c.Email.SMTP.Timeout > 0, "email.smtp.timeout must be positive")
+	case EmailProviderFile:
+		check(c.Email.Dir != "", "email.dir (EMAIL_DIR) is required for the file provider")
+	default:
+		check(false, "email.provider (EMAIL_PROVIDER) must be one of %s, %s, %s, got %q",
+			EmailProviderGateway, EmailProviderSMTP, EmailProviderFile, c.Email.Provider)
+	}
+	if c.Email.Provider != EmailProviderGateway {
+		_, err := mail.ParseAddress(c.Email.From)
+		check(err == nil, "email.from (EMAIL_FROM) must be an email address, got %q", c.Email.From)
+	}
+
+	check(c.EmailConfirmation.SigningKey == "" || len(c.EmailConfirmation.SigningKey) >= minEmailConfirmationKeyLength,
+		"email_confirmation.signing_key (EMAIL_CONFIRMATION_SIGNING_KEY) must be at least %d bytes long", minEmailConfirmationKeyLength)
+	if u, err := url.Parse(c.EmailConfirmation.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		check(false, "email_confirmation.base_url (PUBLIC_BASE_URL) must be an absolute URL, got %q", c.EmailConfirmation.BaseURL)
+	}
+	check(c.EmailConfirmation.TTL > 0, "email_confirmation.ttl must be positive")
+	check(c.EmailConfirmation.ExpiryInterval > 0, "email_confirmation.expiry_interval must be positive")
+
+	checkRetry := func(name string, retryConfig RetryConfig) {
+		check(retryConfig.MaxRetries >= 0, "retry.%s.max_retries must not be negative", name)
+		check(retryConfig.InitialInterval > 0, "retry.%s.initial_interval must be positive", name)
+		check(retryConfig.MaxInterval >= retryConfig.InitialInterval, "retry.%s.max_interval must not be shorter than initial_interval", name)
+	}
+	checkRetry("default", c.Retry.Default)
+	for _, handlerName := range slices.Sorted(maps.Keys(c.Retry.PerHandler)) {
+		checkRetry("per_handler."+handlerName, c.Retry.PerHandler[handlerName])
+	}
+
+	check(c.ProcessedMessages.HandlerTimeout > 0, "processed_messages.handler_timeout must be positive")
+	check(c.ProcessedMessages.Retention > 0, "processed_messages.retention must be positive")
+	check(c.ProcessedMessages.CleanupInterval > 0, "processed_messages.cleanup_interval must be positive")
+	check(c.ProcessedMessages.BatchSize > 0, "processed_messages.batch_size must be positive")
+
+	check(c.OutboxMonitor.Interval > 0, "outbox_monitor.interval must be positive")
+	check(c.OutboxMonitor.MaxPendingAge >= 0, "outbox_monitor.max_pending_age must not be negative")
+	check(c.OutboxMonitor.MaxPendingMessages >= 0, "outbox_monitor.max_pending_messages must not be negative")
+
+	check(c.OutboxCleaner.Interval > 0, "outbox_cleaner.interval must be positive")
+	check(c.OutboxCleaner.Retention > 0, "outbox_cleaner.retention must be positive")
+	check(c.OutboxCleaner.BatchSize > 0, "outbox_cleaner.batch_size must be positive")
+
+	check(c.Shutdown.HTTPTimeout > 0, "shutdown.http_timeout must be positive")
+	check(c.Shutdown.OutboxTimeout > 0, "shutdown.outbox_timeout must be positive")
+	check(c.Shutdown.ForwarderTimeout > 0, "shutdown.forwarder_timeout must be positive")
+	check(c.Shutdown.RouterTimeout > 0, "shutdown.router_timeout must be positive")
+
+	return errors.Join(errs...)
+}
+
+// ValidateDB checks the database config only.
+func (c Config) ValidateDB() error {
+	if c.PostgresURL == "" {
+		return errors.New("postgres_url (POSTGRES_URL) is required")
+	}
+	return nil
+}
+
+// envLoader overrides config values with environment variables that are set,
+// collecting parse errors instead of stopping at the first one.
+type envLoader struct {
+	errs []error
+}
+
+func (l *envLoader) String(key string, dst *string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = v
+	}
+}
+
+func (l *envLoader) List(key string, dst *[]string) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		list = append(list, strings.TrimSpace(item))
+	}
+	*dst = list
+}
+
+func (l *envLoader) Int(key string, dst *int) {
+	l.parse(key, func(v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*dst = i
+		return nil
+	})
+}
+
+func (l *envLoader) Bool(key string, dst *bool) {
+	l.parse(key, func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*dst = b
+		return nil
+	})
+}
+
+func (l *envLoader) Duration(key string, dst *time.Duration) {
+	l.parse(key, func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*dst = d
+		return nil
+	})
+}
+
+func (l *envLoader) Text(key string, dst encoding.TextUnmarshaler) {
+	l.parse(key, func(v string) error {
+		return dst.UnmarshalText([]byte(v))
+	})
+}
+
+func (l *envLoader) parse(key string, parse func(v string) error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+	if err := parse(v); err != nil {
+		l.errs = append(l.errs, fmt.Errorf("invalid %s: %w", key, err))
+	}
+}
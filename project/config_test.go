@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setConfigEnv sets the environment variables read by LoadConfig, unsetting the ones that are empty,
+// and restores them when the test ends.
+func setConfigEnv(t *testing.T, env map[string]string) {
+	t.Helper()
+
+	for _, key := range []string{ConfigFileEnv, "POSTGRES_URL", "HTTP_PORT", "HTTP_READ_TIMEOUT", "GATEWAY_ADDR", "PUBSUB_BACKEND", "KAFKA_ADDR", "SMTP_REQUIRE_TLS"} {
+		t.Setenv(key, env[key])
+		if env[key] == "" {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig_precedence(t *testing.T) {
+	path := writeConfigFile(t, `
+postgres_url: postgres://file/db
+http:
+  port: 9000
+  read_timeout: 5s
+gateway:
+  addr: http://gateway.file
+pubsub:
+  backend: gochannel
+`)
+	setConfigEnv(t, map[string]string{
+		ConfigFileEnv:  path,
+		"POSTGRES_URL": "postgres://env/db",
+		"HTTP_PORT":    "9100",
+	})
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Environment variables override the file.
+	if config.PostgresURL != "postgres://env/db" {
+		t.Errorf("expected the postgres URL from the environment, got %q", config.PostgresURL)
+	}
+	if config.HTTP.Port != 9100 {
+		t.Errorf("expected the port from the environment, got %d", config.HTTP.Port)
+	}
+
+	// The file overrides the defaults.
+	if config.HTTP.ReadTimeout != 5*time.Second {
+		t.Errorf("expected the read timeout from the file, got %s", config.HTTP.ReadTimeout)
+	}
+	if config.Gateway.Addr != "http://gateway.file" {
+		t.Errorf("expected the gateway address from the file, got %q", config.Gateway.Addr)
+	}
+	if config.PubSub.Backend != PubSubBackendGoChannel {
+		t.Errorf("expected the backend from the file, got %q", config.PubSub.Backend)
+	}
+
+	// Values set nowhere keep their defaults.
+	if want := DefaultConfig().HTTP.WriteTimeout; config.HTTP.WriteTimeout != want {
+		t.Errorf("expected the default write timeout %s, got %s", want, config.HTTP.WriteTimeout)
+	}
+	if !config.Email.SMTP.RequireTLS {
+		t.Error("expected SMTP to require TLS by default")
+	}
+	if want := DefaultConfig().Gateway.CRM; config.Gateway.CRM != want {
+		t.Errorf("expected the default CRM client config %+v, got %+v", want, config.Gateway.CRM)
+	}
+}
+
+func TestLoadConfig_unknownField(t *testing.T) {
+	setConfigEnv(t, map[string]string{
+		ConfigFileEnv: writeConfigFile(t, "http:\n  prot: 9000\n"),
+	})
+
+	_, err := LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "prot") {
+		t.Errorf("expected an error about the unknown field, got %v", err)
+	}
+}
+
+func TestLoadConfig_multipleErrors(t *testing.T) {
+	setConfigEnv(t, map[string]string{
+		"HTTP_PORT":         "70000",
+		"HTTP_READ_TIMEOUT": "soon",
+		"GATEWAY_ADDR":      "gateway:8080",
+		"PUBSUB_BACKEND":    "kafka",
+	})
+
+	_, err := LoadConfig()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	for _, want := range []string{
+		"POSTGRES_URL",
+		"HTTP_PORT",
+		"HTTP_READ_TIMEOUT",
+		"GATEWAY_ADDR",
+		"KAFKA_ADDR",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %s, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	config := DefaultConfig()
+	config.PostgresURL = "postgres://localhost/db"
+	config.Gateway.Addr = "http://localhost:8081"
+	config.PubSub.KafkaBrokers = []string{"localhost:9092"}
+
+	if err := config.Validate(); err != nil {
+		t.Fatalf("expected the config to be valid, got:\n%v", err)
+	}
+
+	config.HTTP.Port = 0
+	config.Gateway.CRM.Timeout = 0
+	config.OutboxCleaner.BatchSize = -1
+
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"http.port", "gateway.crm.timeout", "outbox_cleaner.batch_size"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected the error to mention %s, got:\n%v", want, err)
+		}
+	}
+	if n := len(strings.Split(err.Error(), "\n")); n != 3 {
+		t.Errorf("expected 3 errors, got %d:\n%v", n, err)
+	}
+}
+
+func TestLoadMigrateConfig(t *testing.T) {
+	// Nothing but the database is configured.
+	setConfigEnv(t, map[string]string{
+		"POSTGRES_URL": "postgres://localhost/db",
+	})
+
+	if _, err := LoadConfig(); err == nil {
+		t.Fatal("expected the service config to be invalid")
+	}
+
+	config, err := LoadMigrateConfig()
+	if err != nil {
+		t.Fatalf("expected the migrate config to be valid, got:\n%v", err)
+	}
+	if config.PostgresURL != "postgres://localhost/db" {
+		t.Errorf("expected the postgres URL to be loaded, got %q", config.PostgresURL)
+	}
+
+	setConfigEnv(t, map[string]string{})
+	if _, err := LoadMigrateConfig(); err == nil || !strings.Contains(err.Error(), "POSTGRES_URL") {
+		t.Errorf("expected an error about POSTGRES_URL, got %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/labstack/echo/v4"
+)
+
+// CorrelationIDMetadataKey carries the X-Request-ID of the HTTP request that caused a message,
+// through the outbox, the forwarder and the splitter, to the event handlers.
+const CorrelationIDMetadataKey = "correlation_id"
+
+type correlationIDContextKey struct{}
+
+func ContextWithCorrelationID(ctx context.Context, correlationID string) context.Context {
+	return context.WithValue(ctx, correlationIDContextKey{}, correlationID)
+}
+
+func CorrelationIDFromContext(ctx context.Context) string {
+	correlationID, _ := ctx.Value(correlationIDContextKey{}).(string)
+	return correlationID
+}
+
+// echoCorrelationIDMiddleware stores the request ID in the request context.
+// It must run after echo's RequestID middleware.
+func echoCorrelationIDMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		reqID := c.Response().Header().Get(echo.HeaderXRequestID)
+
+		req := c.Request()
+		c.SetRequest(req.WithContext(ContextWithCorrelationID(req.Context(), reqID)))
+
+		return next(c)
+	}
+}
+
+// setCorrelationIDOnPublish is used as cqrs.EventBusConfig.OnPublish.
+func setCorrelationIDOnPublish(params cqrs.OnEventSendParams) error {
+	if correlationID := CorrelationIDFromContext(params.Message.Context()); correlationID != "" {
+		params.Message.Metadata.Set(CorrelationIDMetadataKey, correlationID)
+	}
+	return nil
+}
+
+// correlationIDMiddleware moves the correlation ID from message metadata to the message context.
+// Messages without one get a new ID, so their handling can still be traced.
+func correlationIDMiddleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) ([]*message.Message, error) {
+		correlationID := msg.Metadata.Get(CorrelationIDMetadataKey)
+		if correlationID == "" {
+			correlationID = watermill.NewUUID()
+			msg.Metadata.Set(CorrelationIDMetadataKey, correlationID)
+		}
+
+		msg.SetContext(ContextWithCorrelationID(msg.Context(), correlationID))
+
+		return h(msg)
+	}
+}
+
+// correlationIDLogHandler adds the correlation ID from the context to every log record.
+type correlationIDLogHandler struct {
+	slog.Handler
+}
+
+func (h correlationIDLogHandler) Handle(ctx context.Context, record slog.Record) error {
+	if correlationID := CorrelationIDFromContext(ctx); correlationID != "" {
+		record.AddAttrs(slog.String("correlation_id", correlationID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h correlationIDLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return correlationIDLogHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h correlationIDLogHandler) WithGroup(name string) slog.Handler {
+	return correlationIDLogHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/labstack/echo/v4"
+	echomiddleware "github.com/labstack/echo/v4/middleware"
+)
+
+func TestEchoCorrelationIDMiddleware(t *testing.T) {
+	testCases := []struct {
+		name      string
+		requestID string
+	}{
+		{name: "from_request", requestID: "request-id-from-client"},
+		{name: "generated"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e := echo.New()
+			e.Use(echomiddleware.RequestID(), echoCorrelationIDMiddleware)
+
+			var correlationID string
+			e.GET("/", func(c echo.Context) error {
+				correlationID = CorrelationIDFromContext(c.Request().Context())
+				return c.NoContent(http.StatusOK)
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.requestID != "" {
+				req.Header.Set(echo.HeaderXRequestID, tc.requestID)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			responseID := rec.Header().Get(echo.HeaderXRequestID)
+			if correlationID == "" || correlationID != responseID {
+				t.Errorf("expected the correlation ID to be the response's request ID %q, got %q", responseID, correlationID)
+			}
+			if tc.requestID != "" && correlationID != tc.requestID {
+				t.Errorf("expected the client's request ID %q, got %q", tc.requestID, correlationID)
+			}
+		})
+	}
+}
+
+func TestCorrelationIDMiddleware(t *testing.T) {
+	testCases := []struct {
+		name          string
+		correlationID string
+	}{
+		{name: "from_metadata", correlationID: "request-id-from-client"},
+		// Messages published outside of an HTTP request.
+		{name: "generated"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := message.NewMessage(watermill.NewUUID(), nil)
+			if tc.correlationID != "" {
+				msg.Metadata.Set(CorrelationIDMetadataKey, tc.correlationID)
+			}
+
+			var handled string
+			_, err := correlationIDMiddleware(func(msg *message.Message) ([]*message.Message, error) {
+				handled = CorrelationIDFromContext(msg.Context())
+				return nil, nil
+			})(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if handled == "" || handled != msg.Metadata.Get(CorrelationIDMetadataKey) {
+				t.Errorf("expected the handler to get the correlation ID from metadata %q, got %q",
+					msg.Metadata.Get(CorrelationIDMetadataKey), handled)
+			}
+			if tc.correlationID != "" && handled != tc.correlationID {
+				t.Errorf("expected correlation ID %q, got %q", tc.correlationID, handled)
+			}
+		})
+	}
+}
+
+func TestCorrelationIDLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(correlationIDLogHandler{Handler: slog.NewTextHandler(&buf, nil)}).With("handler", "Test")
+
+	logger.InfoContext(ContextWithCorrelationID(context.Background(), "correlation-id-1"), "with correlation ID")
+	logger.InfoContext(context.Background(), "without correlation ID")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %q", buf.String())
+	}
+	if !strings.Contains(lines[0], "correlation_id=correlation-id-1") || !strings.Contains(lines[0], "handler=Test") {
+		t.Errorf("expected the correlation ID and the logger's attributes, got %q", lines[0])
+	}
+	if strings.Contains(lines[1], "correlation_id") {
+		t.Errorf("expected no correlation ID, got %q", lines[1])
+	}
+}
+
+// TestService_correlationID follows the request ID from POST /users through the outbox to the email gateway.
+func TestService_correlationID(t *testing.T) {
+	s := newTestService(t)
+
+	email := "user-" + randomHex(t, 4) + "@example.com"
+	requestID := "request-" + randomHex(t, 8)
+
+	req, err := http.NewRequest(http.MethodPost, s.url("/users"), strings.NewReader(`{"name": "Test User", "email": "`+email+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(echo.HeaderXRequestID, requestID)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("POST /users returned %d", resp.StatusCode)
+	}
+
+	waitForExactlyOnce(t, "welcome email", func() int {
+		return len(s.gateway.Emails(email, "Welcome to our website!"))
+	})
+
+	if ids := s.gateway.EmailRequestIDs(email); len(ids) != 1 || ids[0] != requestID {
+		t.Errorf("expected the gateway to get request ID %s, got %v", requestID, ids)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type CRMBatchConfig struct {
+	// When Enabled, AddToCRM only queues users in the crm_user_queue table, and CRMBatcher sends them
+	// in bulk requests of up to MaxSize users, checking for queued users every Window.
+	// Messages are acked once their user is queued, not when the CRM accepts it.
+	Enabled bool          `yaml:"enabled"`
+	MaxSize int           `yaml:"max_size"`
+	Window  time.Duration `yaml:"window"`
+
+	// Users that failed with a retryable error are sent again with the backoff of Retry,
+	// up to MaxRetries times. After that, or after a non-retryable error, they stay queued with failed_at set.
+	Retry RetryConfig `yaml:"retry"`
+
+	// Lease is how long a batch is claimed while it's sent. Users of a batch that was interrupted,
+	// like by a crash, are sent again once the lease ends. It also limits the bulk request with its retries.
+	Lease time.Duration `yaml:"lease"`
+}
+
+func DefaultCRMBatchConfig() CRMBatchConfig {
+	return CRMBatchConfig{
+		MaxSize: 50,
+		Window:  time.Second,
+		Retry: RetryConfig{
+			MaxRetries:      10,
+			InitialInterval: time.Second,
+			MaxInterval:     5 * time.Minute,
+		},
+		Lease: time.Minute,
+	}
+}
+
+// CRMClient sends users to the CRM. Each user is sent with an idempotency key derived from its ID,
+// and the CRM treats a known user as an update, so a repeated delivery doesn't create a duplicate.
+type CRMClient struct {
+	usersEndpoint     string
+	usersBulkEndpoint string
+	client            *GatewayClient
+}
+
+func NewCRMClient(gatewayAddr string, config GatewayClientConfig) *CRMClient {
+	return &CRMClient{
+		usersEndpoint:     gatewayAddr + CRMUsersPath,
+		usersBulkEndpoint: gatewayAddr + CRMUsersBulkPath,
+		client:            NewGatewayClient("crm", config),
+	}
+}
+
+type SendUserToCRMRequest struct {
+	UserID uuid.UUID `json:"user_id"`
+	Name   string    `json:"name"`
+	Email  string    `json:"email"`
+}
+
+type SendUsersToCRMRequest struct {
+	Users []CRMBulkUser `json:"users"`
+}
+
+type CRMBulkUser struct {
+	SendUserToCRMRequest
+	IdempotencyKey string `json:"idempotency_key"`
+}
+
+// SendUsersToCRMResponse has a result for each user, the bulk request can partially fail.
+type SendUsersToCRMResponse struct {
+	Results []CRMUserResult `json:"results"`
+}
+
+type CRMUserResult struct {
+	UserID uuid.UUID `json:"user_id"`
+	Status int       `json:"status"`
+	Error  string    `json:"error"`
+}
+
+// SendUserToCRM returns a GatewayError, see IsRetryable.
+func (c *CRMClient) SendUserToCRM(ctx context.Context, userID uuid.UUID, name string, email string) (err error) {
+	ctx, span := tracer().Start(ctx, "CRMClient.SendUserToCRM", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		observeGatewayCall("crm", err)
+		endSpan(span, err)
+	}()
+
+	user := SendUserToCRMRequest{
+		UserID: userID,
+		Name:   name,
+		Email:  email,
+	}
+
+	err = c.client.Post(ctx, GatewayRequest{
+		URL:    c.usersEndpoint,
+		Header: http.Header{"Idempotency-Key": {crmIdempotencyKey(userID)}},
+		Body:   user,
+	})
+
+	var gatewayErr *GatewayError
+	if errors.As(err, &gatewayErr) && gatewayErr.StatusCode == http.StatusConflict {
+		// The user was already added by an earlier delivery.
+		return nil
+	}
+
+	return err
+}
+
+// sendUsers sends users in one bulk request and returns the result of each of them,
+// or an error if the whole request failed.
+func (c *CRMClient) sendUsers(ctx context.Context, users []SendUserToCRMRequest) (results []error, err error) {
+	ctx, span := tracer().Start(
+		ctx,
+		"CRMClient.SendUsersToCRM",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int("crm.users", len(users))),
+	)
+	defer func() {
+		observeGatewayCall("crm", err)
+		endSpan(span, err)
+	}()
+
+	req := SendUsersToCRMRequest{}
+	for _, user := range users {
+		req.Users = append(req.Users, CRMBulkUser{
+			SendUserToCRMRequest: user,
+			IdempotencyKey:       crmIdempotencyKey(user.UserID),
+		})
+	}
+
+	var resp SendUsersToCRMResponse
+	err = c.client.Post(ctx, GatewayRequest{
+		URL:      c.usersBulkEndpoint,
+		Body:     req,
+		Response: &resp,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	byUserID := make(map[uuid.UUID]CRMUserResult, len(resp.Results))
+	for _, result := range resp.Results {
+		byUserID[result.UserID] = result
+	}
+
+	results = make([]error, len(users))
+	for i, user := range users {
+		result, ok := byUserID[user.UserID]
+		if !ok {
+			results[i] = &GatewayError{Gateway: "crm", Retryable: true, Err: errors.New("no result for user in bulk response")}
+			continue
+		}
+		results[i] = crmUserResultError(result)
+	}
+
+	return results, nil
+}
+
+func crmUserResultError(result CRMUserResult) error {
+	if result.Status >= 200 && result.Status < 300 || result.Status == http.StatusConflict {
+		return nil
+	}
+
+	message := result.Error
+	if message == "" {
+		message = http.StatusText(result.Status)
+	}
+
+	return &GatewayError{
+		Gateway:    "crm",
+		StatusCode: result.Status,
+		Retryable:  isRetryableStatus(result.Status),
+		Err:        errors.New(message),
+	}
+}
+
+func crmIdempotencyKey(userID uuid.UUID) string {
+	return "crm-user-" + userID.String()
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// CRMBatcher adds users to the CRM. With batching enabled, users are queued in the database and Run
+// sends them in bulk requests, otherwise they are sent right away.
+//
+// Handlers only wait for the user to be queued, so users from all messages handled within a window
+// end up in one batch, no matter how many of them are handled concurrently.
+type CRMBatcher struct {
+	db     *sqlx.DB
+	crm    *CRMClient
+	config CRMBatchConfig
+}
+
+func NewCRMBatcher(db *sqlx.DB, crm *CRMClient, config CRMBatchConfig) *CRMBatcher {
+	return &CRMBatcher{
+		db:     db,
+		crm:    crm,
+		config: config,
+	}
+}
+
+// AddUser returns a GatewayError when the user is sent right away, see IsRetryable.
+// A user is queued in the transaction of the idempotent handler, so it's queued once per message.
+// Queueing a user again, like after its email changed, replaces the queued one.
+func (b *CRMBatcher) AddUser(ctx context.Context, user SendUserToCRMRequest) error {
+	if !b.config.Enabled {
+		return b.crm.SendUserToCRM(ctx, user.UserID, user.Name, user.Email)
+	}
+
+	var db sqlx.ExecerContext = b.db
+	if tx, ok := TxFromContext(ctx); ok {
+		db = tx
+	}
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO crm_user_queue (user_id, name, email)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET name = excluded.name,
+			email = excluded.email,
+			attempts = 0,
+			next_attempt_at = now(),
+			last_error = NULL,
+			failed_at = NULL,
+			enqueued_at = now()
+	`, user.UserID, user.Name, user.Email)
+	if err != nil {
+		return fmt.Errorf("failed to queue user for CRM: %w", err)
+	}
+
+	return nil
+}
+
+// Run sends queued users every Window. It also runs with batching disabled,
+// to send users that were queued before batching was disabled.
+func (b *CRMBatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(b.config.Window)
+	defer ticker.Stop()
+
+	for {
+		sent, err := b.Flush(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.With("error", err).Error("Failed to send queued users to CRM")
+		}
+		if sent > 0 {
+			slog.Debug("Sent queued users to CRM", "users", sent)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Flush sends all users that are due, in batches of up to MaxSize,
+// and returns the number of users the CRM accepted.
+func (b *CRMBatcher) Flush(ctx context.Context) (int, error) {
+	var total int
+
+	for {
+		claimed, sent, err := b.sendBatch(ctx)
+		total += sent
+
+		if err != nil {
+			return total, err
+		}
+		if claimed < b.config.MaxSize {
+			return total, nil
+		}
+	}
+}
+
+type crmQueuedUser struct {
+	UserID     uuid.UUID `db:"user_id"`
+	Name       string    `db:"name"`
+	Email      string    `db:"email"`
+	Attempts   int       `db:"attempts"`
+	EnqueuedAt time.Time `db:"enqueued_at"`
+}
+
+func (b *CRMBatcher) sendBatch(ctx context.Context) (claimed int, sent int, err error) {
+	// Claiming pushes next_attempt_at past the lease, so other instances skip the batch while it's sent.
+	var users []crmQueuedUser
+	err = b.db.SelectContext(ctx, &users, `
+		WITH batch AS (
+			SELECT user_id
+			FROM crm_user_queue
+			WHERE failed_at IS NULL AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		UPDATE crm_user_queue q
+		SET attempts = q.attempts + 1, next_attempt_at = now() + make_interval(secs => $2)
+		FROM batch b
+		WHERE q.user_id = b.user_id
+		RETURNING q.user_id, q.name, q.email, q.attempts, q.enqueued_at
+	`, b.config.MaxSize, b.config.Lease.Seconds())
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to claim queued users: %w", err)
+	}
+	if len(users) == 0 {
+		return 0, 0, nil
+	}
+
+	requests := make([]SendUserToCRMRequest, len(users))
+	for i, user := range users {
+		requests[i] = SendUserToCRMRequest{
+			UserID: user.UserID,
+			Name:   user.Name,
+			Email:  user.Email,
+		}
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, b.config.Lease)
+	results, err := b.crm.sendUsers(sendCtx, requests)
+	cancel()
+
+	if ctx.Err() != nil {
+		// The users are sent again when the lease ends.
+		return len(users), 0, ctx.Err()
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to send batch of %d users to CRM: %w", len(users), err)
+		results = make([]error, len(users))
+		for i := range results {
+			results[i] = err
+		}
+	}
+
+	for i, user := range users {
+		if err := b.recordResult(ctx, user, results[i]); err != nil {
+			return len(users), sent, err
+		}
+		if results[i] == nil {
+			sent++
+		}
+	}
+
+	return len(users), sent, nil
+}
+
+// recordResult removes a user that was sent, or schedules the next attempt.
+// Users queued again while the batch was sent are left for the next batch.
+func (b *CRMBatcher) recordResult(ctx context.Context, user crmQueuedUser, sendErr error) error {
+	if sendErr == nil {
+		_, err := b.db.ExecContext(ctx, `
+			DELETE FROM crm_user_queue
+			WHERE user_id = $1 AND enqueued_at = $2
+		`, user.UserID, user.EnqueuedAt)
+		if err != nil {
+			return fmt.Errorf("failed to remove user sent to CRM: %w", err)
+		}
+		return nil
+	}
+
+	if IsRetryable(sendErr) && user.Attempts <= b.config.Retry.MaxRetries {
+		_, err := b.db.ExecContext(ctx, `
+			UPDATE crm_user_queue
+			SET next_attempt_at = now() + make_interval(secs => $3), last_error = $4
+			WHERE user_id = $1 AND enqueued_at = $2
+		`, user.UserID, user.EnqueuedAt, b.backoff(user.Attempts).Seconds(), sendErr.Error())
+		if err != nil {
+			return fmt.Errorf("failed to schedule sending user to CRM again: %w", err)
+		}
+		return nil
+	}
+
+	// Failed users stay in the queue until they're queued again, they're counted by the
+	// crm_queue_failed_users metric.
+	slog.With(
+		"error", sendErr,
+		"user_id", user.UserID.String(),
+		"attempts", user.Attempts,
+	).Error("Failed to send user to CRM, giving up")
+
+	_, err := b.db.ExecContext(ctx, `
+		UPDATE crm_user_queue
+		SET failed_at = now(), last_error = $3
+		WHERE user_id = $1 AND enqueued_at = $2
+	`, user.UserID, user.EnqueuedAt, sendErr.Error())
+	if err != nil {
+		return fmt.Errorf("failed to mark user as failed to send to CRM: %w", err)
+	}
+
+	return nil
+}
+
+type CRMQueueStats struct {
+	Queued int64
+	Failed int64
+}
+
+// GetCRMQueueStats counts the users waiting to be sent to the CRM, and the ones that failed.
+func GetCRMQueueStats(ctx context.Context, db *sqlx.DB) (CRMQueueStats, error) {
+	var stats CRMQueueStats
+	err := db.QueryRowContext(ctx, `
+		SELECT
+			count(*) FILTER (WHERE failed_at IS NULL),
+			count(*) FILTER (WHERE failed_at IS NOT NULL)
+		FROM crm_user_queue
+	`).Scan(&stats.Queued, &stats.Failed)
+	if err != nil {
+		return CRMQueueStats{}, fmt.Errorf("failed to get CRM queue stats: %w", err)
+	}
+	return stats, nil
+}
+
+// backoff returns the wait before the next attempt, after the given number of attempts.
+func (b *CRMBatcher) backoff(attempts int) time.Duration {
+	backoff := b.config.Retry.InitialInterval
+	for i := 1; i < attempts && backoff < b.config.Retry.MaxInterval; i++ {
+		backoff *= 2
+	}
+	return min(backoff, b.config.Retry.MaxInterval)
+}
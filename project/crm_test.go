@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+// fakeCRM responds to bulk requests with a result for each user: 201, or the status set for the user.
+// Users with status 0 are left out of the response.
+type fakeCRM struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses map[uuid.UUID]int
+	requests []SendUsersToCRMRequest
+}
+
+func newFakeCRM(t *testing.T, statuses map[uuid.UUID]int) *fakeCRM {
+	t.Helper()
+
+	c := &fakeCRM{statuses: statuses}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+CRMUsersBulkPath, func(w http.ResponseWriter, r *http.Request) {
+		var req SendUsersToCRMRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.requests = append(c.requests, req)
+
+		var resp SendUsersToCRMResponse
+		for _, user := range req.Users {
+			status, ok := c.statuses[user.UserID]
+			if !ok {
+				status = http.StatusCreated
+			}
+			if status == 0 {
+				continue
+			}
+			resp.Results = append(resp.Results, CRMUserResult{
+				UserID: user.UserID,
+				Status: status,
+				Error:  http.StatusText(status),
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+
+	c.Server = httptest.NewServer(mux)
+	t.Cleanup(c.Close)
+
+	return c
+}
+
+// BatchSizes returns the number of users in each bulk request.
+func (c *fakeCRM) BatchSizes() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var sizes []int
+	for _, req := range c.requests {
+		sizes = append(sizes, len(req.Users))
+	}
+	return sizes
+}
+
+func newTestCRMUsers(n int) []SendUserToCRMRequest {
+	users := make([]SendUserToCRMRequest, n)
+	for i := range users {
+		users[i] = SendUserToCRMRequest{
+			UserID: uuid.Must(uuid.NewV7()),
+			Name:   "Test User",
+			Email:  "user-" + uuid.Must(uuid.NewV4()).String()[:8] + "@example.com",
+		}
+	}
+	return users
+}
+
+func TestCRMClient_sendUsers_partialFailure(t *testing.T) {
+	users := newTestCRMUsers(5)
+
+	crm := newFakeCRM(t, map[uuid.UUID]int{
+		users[1].UserID: http.StatusConflict,
+		users[2].UserID: http.StatusBadRequest,
+		users[3].UserID: http.StatusServiceUnavailable,
+		users[4].UserID: 0,
+	})
+	client := NewCRMClient(crm.URL, testGatewayClientConfig())
+
+	results, err := client.sendUsers(context.Background(), users)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name          string
+		wantErr       bool
+		wantRetryable bool
+	}{
+		{name: "created"},
+		// An earlier delivery already added the user.
+		{name: "conflict"},
+		{name: "bad_request", wantErr: true, wantRetryable: false},
+		{name: "unavailable", wantErr: true, wantRetryable: true},
+		{name: "missing_from_response", wantErr: true, wantRetryable: true},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := results[i]
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if err != nil && IsRetryable(err) != tc.wantRetryable {
+				t.Errorf("expected retryable %v, got %v", tc.wantRetryable, IsRetryable(err))
+			}
+		})
+	}
+
+	if sizes := crm.BatchSizes(); len(sizes) != 1 || sizes[0] != len(users) {
+		t.Fatalf("expected one bulk request with %d users, got %v", len(users), sizes)
+	}
+	for i, user := range crm.requests[0].Users {
+		if want := crmIdempotencyKey(users[i].UserID); user.IdempotencyKey != want {
+			t.Errorf("expected idempotency key %s, got %s", want, user.IdempotencyKey)
+		}
+	}
+}
+
+func TestCRMClient_sendUsers_requestFailed(t *testing.T) {
+	server, calls := newTestGateway(t, nil, http.StatusInternalServerError)
+	client := NewCRMClient(server.URL, testGatewayClientConfig())
+
+	results, err := client.sendUsers(context.Background(), newTestCRMUsers(2))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !IsRetryable(err) {
+		t.Errorf("expected a retryable error, got %v", err)
+	}
+	if results != nil {
+		t.Errorf("expected no results, got %v", results)
+	}
+	if n := calls.Load(); n != int32(testGatewayClientConfig().MaxRetries+1) {
+		t.Errorf("expected the request to be retried, got %d calls", n)
+	}
+}
+
+func TestCRMClient_SendUserToCRM(t *testing.T) {
+	testCases := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "created", status: http.StatusCreated},
+		{name: "already_added", status: http.StatusConflict},
+		{name: "rejected", status: http.StatusBadRequest, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			user := newTestCRMUsers(1)[0]
+
+			var idempotencyKey string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				idempotencyKey = r.Header.Get("Idempotency-Key")
+				w.WriteHeader(tc.status)
+			}))
+			t.Cleanup(server.Close)
+
+			client := NewCRMClient(server.URL, testGatewayClientConfig())
+
+			err := client.SendUserToCRM(context.Background(), user.UserID, user.Name, user.Email)
+			if (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if want := crmIdempotencyKey(user.UserID); idempotencyKey != want {
+				t.Errorf("expected idempotency key %s, got %s", want, idempotencyKey)
+			}
+		})
+	}
+}
+
+func TestCRMBatcher_backoff(t *testing.T) {
+	batcher := NewCRMBatcher(nil, nil, CRMBatchConfig{
+		Retry: RetryConfig{InitialInterval: time.Second, MaxInterval: 10 * time.Second},
+	})
+
+	for attempts, want := range map[int]time.Duration{
+		1:   time.Second,
+		2:   2 * time.Second,
+		4:   8 * time.Second,
+		5:   10 * time.Second,
+		100: 10 * time.Second,
+	} {
+		if got := batcher.backoff(attempts); got != want {
+			t.Errorf("backoff after %d attempts: expected %s, got %s", attempts, want, got)
+		}
+	}
+}
+
+func testCRMBatchConfig() CRMBatchConfig {
+	return CRMBatchConfig{
+		Enabled: true,
+		MaxSize: 2,
+		Window:  time.Hour,
+		Retry: RetryConfig{
+			MaxRetries:      1,
+			InitialInterval: time.Hour,
+			MaxInterval:     time.Hour,
+		},
+		Lease: time.Minute,
+	}
+}
+
+type crmQueueRow struct {
+	Attempts      int        `db:"attempts"`
+	NextAttemptAt time.Time  `db:"next_attempt_at"`
+	LastError     *string    `db:"last_error"`
+	FailedAt      *time.Time `db:"failed_at"`
+}
+
+func getCRMQueueRow(t *testing.T, batcher *CRMBatcher, userID uuid.UUID) (crmQueueRow, bool) {
+	t.Helper()
+
+	var row crmQueueRow
+	err := batcher.db.Get(&row, `
+		SELECT attempts, next_attempt_at, last_error, failed_at
+		FROM crm_user_queue
+		WHERE user_id = $1
+	`, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return crmQueueRow{}, false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return row, true
+}
+
+func TestCRMBatcher_Flush(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	users := newTestCRMUsers(5)
+	permanent, temporary := users[2].UserID, users[3].UserID
+
+	crm := newFakeCRM(t, map[uuid.UUID]int{
+		permanent: http.StatusBadRequest,
+		temporary: http.StatusServiceUnavailable,
+	})
+	batcher := NewCRMBatcher(db, NewCRMClient(crm.URL, testGatewayClientConfig()), testCRMBatchConfig())
+
+	for _, user := range users {
+		if err := batcher.AddUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sizes := crm.BatchSizes(); len(sizes) != 0 {
+		t.Fatalf("expected users to be queued, got requests %v", sizes)
+	}
+
+	sent, err := batcher.Flush(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 3 {
+		t.Errorf("expected 3 users sent, got %d", sent)
+	}
+	if sizes := crm.BatchSizes(); len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 2 || sizes[2] != 1 {
+		t.Errorf("expected batches of 2, 2 and 1 users, got %v", sizes)
+	}
+
+	for _, user := range users {
+		row, queued := getCRMQueueRow(t, batcher, user.UserID)
+
+		switch user.UserID {
+		case permanent:
+			if !queued || row.FailedAt == nil || row.LastError == nil {
+				t.Errorf("expected the rejected user to be marked as failed, got %+v", row)
+			}
+		case temporary:
+			if !queued || row.FailedAt != nil || row.Attempts != 1 || row.NextAttemptAt.Before(time.Now().Add(30*time.Minute)) {
+				t.Errorf("expected the unavailable user to be retried after the backoff, got %+v", row)
+			}
+		default:
+			if queued {
+				t.Errorf("expected user %s to be removed from the queue, got %+v", user.UserID, row)
+			}
+		}
+	}
+
+	if stats := getCRMQueueStats(t, db); stats != (CRMQueueStats{Queued: 1, Failed: 1}) {
+		t.Errorf("expected 1 queued and 1 failed user, got %+v", stats)
+	}
+
+	// Nothing is due until the backoff ends.
+	if _, err := batcher.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(crm.BatchSizes()); n != 3 {
+		t.Errorf("expected no new requests, got %d requests", n)
+	}
+
+	if _, err := db.Exec(`UPDATE crm_user_queue SET next_attempt_at = now() WHERE user_id = $1`, temporary); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := batcher.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second attempt was the last one allowed by MaxRetries.
+	row, _ := getCRMQueueRow(t, batcher, temporary)
+	if row.FailedAt == nil || row.Attempts != 2 {
+		t.Errorf("expected the user to be marked as failed after 2 attempts, got %+v", row)
+	}
+	if stats := getCRMQueueStats(t, db); stats != (CRMQueueStats{Queued: 0, Failed: 2}) {
+		t.Errorf("expected 2 failed users, got %+v", stats)
+	}
+}
+
+func getCRMQueueStats(t *testing.T, db *sqlx.DB) CRMQueueStats {
+	t.Helper()
+
+	stats, err := GetCRMQueueStats(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestCRMBatcher_AddUser_requeue(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	user := newTestCRMUsers(1)[0]
+	crm := newFakeCRM(t, map[uuid.UUID]int{user.UserID: http.StatusBadRequest})
+	batcher := NewCRMBatcher(db, NewCRMClient(crm.URL, testGatewayClientConfig()), testCRMBatchConfig())
+
+	if err := batcher.AddUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := batcher.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queueing the user again, like after a replay, gives it a fresh start.
+	user.Email = "changed-" + user.Email
+	if err := batcher.AddUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	row, queued := getCRMQueueRow(t, batcher, user.UserID)
+	if !queued || row.FailedAt != nil || row.Attempts != 0 || row.LastError != nil {
+		t.Errorf("expected the user to be queued again, got %+v", row)
+	}
+}
@@ -5,27 +5,113 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func MigrateDB(ctx context.Context, db *sqlx.DB) error {
-	dbSchema := `
-	CREATE TABLE IF NOT EXISTS users (
-		id UUID PRIMARY KEY,
-		name TEXT NOT NULL,
-		email TEXT NOT NULL,
-		registered_at TIMESTAMPTZ NOT NULL
-	);
-	`
-	if _, err := db.ExecContext(ctx, dbSchema); err != nil {
-		return fmt.Errorf("could not create schema: %w", err)
+const (
+	txMaxAttempts    = 5
+	txInitialBackoff = 10 * time.Millisecond
+	txMaxBackoff     = 500 * time.Millisecond
+
+	pgSerializationFailure = "40001"
+	pgDeadlockDetected     = "40P01"
+	pgUniqueViolation      = "23505"
+)
+
+// UpdateInTx runs fn in a transaction with the given isolation level.
+//
+// Serialization failures and deadlocks are retried with exponential backoff and jitter,
+// so fn must be safe to run more than once.
+func UpdateInTx(
+	ctx context.Context,
+	db *sqlx.DB,
+	isolation sql.IsolationLevel,
+	fn func(ctx context.Context, tx *sqlx.Tx) error,
+) (err error) {
+	ctx, span := tracer().Start(ctx, "UpdateInTx", trace.WithAttributes(
+		attribute.String("db.isolation_level", isolation.String()),
+	))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	return retryTx(ctx, func(attempt int) error {
+		span.SetAttributes(attribute.Int("db.tx.attempts", attempt))
+		return updateInTx(ctx, db, isolation, fn)
+	})
+}
+
+// retryTx calls run until it succeeds, up to txMaxAttempts times.
+// Only serialization failures and deadlocks are retried, other errors are returned right away.
+func retryTx(ctx context.Context, run func(attempt int) error) error {
+	backoff := txInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		err := run(attempt)
+		if err == nil {
+			if attempt > 1 {
+				slog.Info("Transaction succeeded after retries", "attempts", attempt)
+			}
+			return nil
+		}
+
+		if !isRetryableTxError(err) {
+			return err
+		}
+		if attempt >= txMaxAttempts {
+			return fmt.Errorf("transaction failed after %d attempts: %w", attempt, err)
+		}
+
+		// Full backoff range is [backoff/2, backoff], so concurrent retries don't collide again.
+		wait := backoff/2 + rand.N(backoff/2+1)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return fmt.Errorf("transaction failed after %d attempts, no time left to retry: %w", attempt, err)
+		}
+
+		slog.Warn("Retrying transaction",
+			"attempt", attempt,
+			"backoff", wait.String(),
+			"error", err,
+		)
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(wait):
+		}
+
+		backoff = min(backoff*2, txMaxBackoff)
+	}
+}
+
+// isRetryableTxError reports whether err is a Postgres serialization failure or deadlock.
+func isRetryableTxError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
 	}
 
-	return nil
+	return pgErr.Code == pgSerializationFailure || pgErr.Code == pgDeadlockDetected
 }
 
-func UpdateInTx(
+// isUniqueViolation reports whether err was caused by the given unique constraint or index.
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+
+	return pgErr.Code == pgUniqueViolation && pgErr.ConstraintName == constraint
+}
+
+func updateInTx(
 	ctx context.Context,
 	db *sqlx.DB,
 	isolation sql.IsolationLevel,
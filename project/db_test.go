@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestRetryTx(t *testing.T) {
+	serializationFailure := &pgconn.PgError{Code: pgSerializationFailure}
+	deadlock := &pgconn.PgError{Code: pgDeadlockDetected}
+	uniqueViolation := &pgconn.PgError{Code: pgUniqueViolation}
+	errFailed := errors.New("failed")
+
+	testCases := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{
+			name:         "succeeds",
+			errs:         []error{nil},
+			wantAttempts: 1,
+		},
+		{
+			name:         "serialization_failure",
+			errs:         []error{serializationFailure, serializationFailure, nil},
+			wantAttempts: 3,
+		},
+		{
+			name:         "deadlock",
+			errs:         []error{deadlock, nil},
+			wantAttempts: 2,
+		},
+		{
+			name:         "not_retryable",
+			errs:         []error{errFailed, nil},
+			wantAttempts: 1,
+			wantErr:      errFailed,
+		},
+		{
+			name:         "unique_violation",
+			errs:         []error{uniqueViolation, nil},
+			wantAttempts: 1,
+			wantErr:      uniqueViolation,
+		},
+		{
+			name:         "max_attempts",
+			errs:         []error{serializationFailure, serializationFailure, serializationFailure, serializationFailure, serializationFailure, nil},
+			wantAttempts: txMaxAttempts,
+			wantErr:      serializationFailure,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var attempts int
+			err := retryTx(context.Background(), func(attempt int) error {
+				attempts++
+				if attempt != attempts {
+					t.Errorf("expected attempt %d, got %d", attempts, attempt)
+				}
+				return tc.errs[attempt-1]
+			})
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if attempts != tc.wantAttempts {
+				t.Errorf("expected %d attempts, got %d", tc.wantAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestRetryTx_deadline(t *testing.T) {
+	// Less than the shortest backoff, so there's no time to retry.
+	ctx, cancel := context.WithTimeout(context.Background(), txInitialBackoff/4)
+	defer cancel()
+
+	var attempts int
+	err := retryTx(ctx, func(int) error {
+		attempts++
+		return &pgconn.PgError{Code: pgSerializationFailure}
+	})
+
+	if err == nil || !strings.Contains(err.Error(), "no time left to retry") {
+		t.Errorf("expected an error about the deadline, got %v", err)
+	}
+	if !isRetryableTxError(err) {
+		t.Errorf("expected the serialization failure to be wrapped, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestRetryTx_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var attempts int
+	err := retryTx(ctx, func(int) error {
+		attempts++
+		cancel()
+		return &pgconn.PgError{Code: pgSerializationFailure}
+	})
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+// TestUpdateInTx_serializable runs two transactions with a write skew: both check that two doctors
+// are on call before taking their own doctor off call. One of them fails to serialize and is retried,
+// so it sees the other one's change.
+func TestUpdateInTx_serializable(t *testing.T) {
+	db := newEmptyTestDB(t)
+	ctx := context.Background()
+
+	_, err := db.Exec(`
+		CREATE TABLE doctors (name TEXT PRIMARY KEY, on_call BOOLEAN NOT NULL);
+		INSERT INTO doctors VALUES ('alice', true), ('bob', true);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Both transactions read before either of them writes.
+	var read sync.WaitGroup
+	read.Add(2)
+
+	var (
+		mu       sync.Mutex
+		attempts int
+	)
+
+	takeOffCall := func(name string) error {
+		var firstAttempt sync.Once
+
+		return UpdateInTx(ctx, db, sql.LevelSerializable, func(ctx context.Context, tx *sqlx.Tx) error {
+			mu.Lock()
+			attempts++
+			mu.Unlock()
+
+			var onCall int
+			if err := tx.GetContext(ctx, &onCall, `SELECT count(*) FROM doctors WHERE on_call`); err != nil {
+				return err
+			}
+
+			firstAttempt.Do(func() {
+				read.Done()
+				read.Wait()
+			})
+
+			if onCall < 2 {
+				return nil
+			}
+
+			_, err := tx.ExecContext(ctx, `UPDATE doctors SET on_call = false WHERE name = $1`, name)
+			return err
+		})
+	}
+
+	errs := make(chan error, 2)
+	for _, name := range []string{"alice", "bob"} {
+		go func() {
+			errs <- takeOffCall(name)
+		}()
+	}
+
+	timeout := time.After(10 * time.Second)
+	for range 2 {
+		select {
+		case err := <-errs:
+			if err != nil {
+				t.Errorf("transaction failed: %v", err)
+			}
+		case <-timeout:
+			t.Fatal("transactions didn't finish")
+		}
+	}
+
+	var onCall int
+	if err := db.Get(&onCall, `SELECT count(*) FROM doctors WHERE on_call`); err != nil {
+		t.Fatal(err)
+	}
+	if onCall != 1 {
+		t.Errorf("expected 1 doctor on call, got %d", onCall)
+	}
+	if attempts <= 2 {
+		t.Errorf("expected a transaction to be retried, got %d attempts", attempts)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/jmoiron/sqlx"
+)
+
+type idempotentEventHandler struct {
+	cqrs.EventHandler
+}
+
+// Idempotent marks an event handler to be run at most once per message.
+// The deduplication is done by ProcessedMessages.OnHandle.
+func Idempotent(handler cqrs.EventHandler) cqrs.EventHandler {
+	return idempotentEventHandler{EventHandler: handler}
+}
+
+type txContextKey struct{}
+
+// TxFromContext returns the transaction an idempotent handler runs in.
+// Database writes done with it are committed together with the processed-message marker.
+func TxFromContext(ctx context.Context) (*sqlx.Tx, bool) {
+	tx, ok := ctx.Value(txContextKey{}).(*sqlx.Tx)
+	return tx, ok
+}
+
+type ProcessedMessagesConfig struct {
+	// HandlerTimeout limits a single run of an event handler, including its gateway retries.
+	// An idempotent handler holds a transaction and a database connection while it runs, so it's also
+	// the longest time they are held. Retries of the router start a new run, with a new transaction.
+	HandlerTimeout time.Duration `yaml:"handler_timeout"`
+
+	// Retention is how long processed messages are remembered. A message redelivered later is handled again,
+	// so it should be longer than the broker keeps messages.
+	Retention time.Duration `yaml:"retention"`
+
+	// CleanupInterval is the time between removals of processed messages older than the retention.
+	CleanupInterval time.Duration `yaml:"cleanup_interval"`
+
+	// BatchSize limits the rows removed by one statement.
+	BatchSize int `yaml:"batch_size"`
+}
+
+func DefaultProcessedMessagesConfig() ProcessedMessagesConfig {
+	return ProcessedMessagesConfig{
+		HandlerTimeout:  time.Minute,
+		Retention:       14 * 24 * time.Hour,
+		CleanupInterval: time.Hour,
+		BatchSize:       1000,
+	}
+}
+
+// ProcessedMessages records which messages were already handled by which handler,
+// so redelivered messages are skipped.
+type ProcessedMessages struct {
+	db             *sqlx.DB
+	handlerTimeout time.Duration
+}
+
+func NewProcessedMessages(db *sqlx.DB, config ProcessedMessagesConfig) *ProcessedMessages {
+	return &ProcessedMessages{
+		db:             db,
+		handlerTimeout: config.HandlerTimeout,
+	}
+}
+
+// OnHandle is used as cqrs.EventProcessorConfig.OnHandle.
+//
+// An idempotent handler runs in the transaction that marks the message as processed, so a failed handler
+// leaves the message unmarked. The transaction stays open while the handler calls the gateways, retries and
+// waits between retries, which is why every handler run is limited to the handler timeout.
+func (p *ProcessedMessages) OnHandle(params cqrs.EventProcessorOnHandleParams) error {
+	ctx, cancel := context.WithTimeout(params.Message.Context(), p.handlerTimeout)
+	defer cancel()
+
+	if _, ok := params.Handler.(idempotentEventHandler); !ok {
+		return params.Handler.Handle(ctx, params.Event)
+	}
+
+	handlerName := params.Handler.HandlerName()
+	messageUUID := params.Message.UUID
+
+	return UpdateInTx(ctx, p.db, sql.LevelReadCommitted, func(ctx context.Context, tx *sqlx.Tx) error {
+		// A concurrent delivery of the same message blocks here until the first one commits or rolls back.
+		res, err := tx.ExecContext(ctx, `
+			INSERT INTO processed_messages (handler_name, message_uuid)
+			VALUES ($1, $2)
+			ON CONFLICT DO NOTHING
+		`, handlerName, messageUUID)
+		if err != nil {
+			return fmt.Errorf("failed to mark message as processed: %w", err)
+		}
+
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			slog.InfoContext(ctx, "Skipping already processed message",
+				"handler", handlerName,
+				"message_uuid", messageUUID,
+			)
+			return nil
+		}
+
+		return params.Handler.Handle(context.WithValue(ctx, txContextKey{}, tx), params.Event)
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func onHandleParams(handler cqrs.EventHandler) cqrs.EventProcessorOnHandleParams {
+	return cqrs.EventProcessorOnHandleParams{
+		Handler:   handler,
+		Event:     &UserRegistered{},
+		EventName: "UserRegistered",
+		Message:   message.NewMessage(watermill.NewUUID(), nil),
+	}
+}
+
+func TestProcessedMessages_OnHandle_timeout(t *testing.T) {
+	processedMessages := NewProcessedMessages(nil, ProcessedMessagesConfig{HandlerTimeout: 50 * time.Millisecond})
+
+	handler := cqrs.NewEventHandler("Blocking", func(ctx context.Context, event *UserRegistered) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	start := time.Now()
+	err := processedMessages.OnHandle(onHandleParams(handler))
+
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("handler ran for %s", elapsed)
+	}
+}
+
+func TestProcessedMessages_OnHandle_skipsProcessedMessages(t *testing.T) {
+	db := newTestDB(t)
+	processedMessages := NewProcessedMessages(db, DefaultProcessedMessagesConfig())
+
+	runs := 0
+	handler := Idempotent(cqrs.NewEventHandler("Counting", func(ctx context.Context, event *UserRegistered) error {
+		if _, ok := TxFromContext(ctx); !ok {
+			t.Error("idempotent handler runs without a transaction")
+		}
+		runs++
+		return nil
+	}))
+
+	params := onHandleParams(handler)
+	for range 2 {
+		if err := processedMessages.OnHandle(params); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if runs != 1 {
+		t.Errorf("expected the handler to run once, ran %d times", runs)
+	}
+}
+
+func TestProcessedMessages_OnHandle_failedHandlerIsRetried(t *testing.T) {
+	db := newTestDB(t)
+	processedMessages := NewProcessedMessages(db, DefaultProcessedMessagesConfig())
+
+	runs := 0
+	handler := Idempotent(cqrs.NewEventHandler("FailingOnce", func(ctx context.Context, event *UserRegistered) error {
+		runs++
+		if runs == 1 {
+			return errors.New("handler failed")
+		}
+		return nil
+	}))
+
+	params := onHandleParams(handler)
+	if err := processedMessages.OnHandle(params); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+	if err := processedMessages.OnHandle(params); err != nil {
+		t.Fatal(err)
+	}
+
+	if runs != 2 {
+		t.Errorf("expected the handler to run twice, ran %d times", runs)
+	}
+}
+
+func TestProcessedMessagesCleaner_Clean(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO processed_messages (handler_name, message_uuid, processed_at)
+		VALUES
+			('Handler', 'old-1', now() - interval '2 hours'),
+			('Handler', 'old-2', now() - interval '3 hours'),
+			('Handler', 'old-3', now() - interval '4 hours'),
+			('Handler', 'recent', now() - interval '1 minute')
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleaner := NewProcessedMessagesCleaner(db, ProcessedMessagesConfig{
+		Retention: time.Hour,
+		BatchSize: 2,
+	})
+
+	removed, err := cleaner.Clean(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("expected 3 removed rows, got %d", removed)
+	}
+
+	var remaining []string
+	if err := db.SelectContext(ctx, &remaining, `SELECT message_uuid FROM processed_messages`); err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0] != "recent" {
+		t.Errorf("expected only the recent row to remain, got %v", remaining)
+	}
+}
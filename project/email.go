@@ -0,0 +1,25 @@
+package main
+
+import (
+	"errors"
+	"net/mail"
+	"strings"
+)
+
+var ErrInvalidEmail = errors.New("invalid email address")
+
+// NormalizeEmail validates an email address against RFC 5322 and returns it in the form stored in the database.
+// Display names and comments ("John <john@example.com>") are rejected, only a bare address is accepted.
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", ErrInvalidEmail
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Name != "" || addr.Address != email {
+		return "", ErrInvalidEmail
+	}
+
+	return strings.ToLower(addr.Address), nil
+}
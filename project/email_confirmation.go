@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+type EmailConfirmationConfig struct {
+	// SigningKey signs confirmation tokens. It must be kept secret and be at least 32 bytes long.
+	// Without it, a random key is generated on startup, which is only good enough for development:
+	// links stop working after a restart and aren't accepted by other instances of the service.
+	SigningKey string `yaml:"signing_key"`
+
+	// BaseURL is the public URL of the service, used in confirmation links.
+	BaseURL string `yaml:"base_url"`
+
+	// TTL is how long a requested email change can be confirmed.
+	TTL time.Duration `yaml:"ttl"`
+
+	// ExpiryInterval is how often unconfirmed changes are checked for expiry.
+	ExpiryInterval time.Duration `yaml:"expiry_interval"`
+}
+
+func DefaultEmailConfirmationConfig() EmailConfirmationConfig {
+	return EmailConfirmationConfig{
+		BaseURL:        "http://localhost:8080",
+		TTL:            24 * time.Hour,
+		ExpiryInterval: time.Minute,
+	}
+}
+
+const minEmailConfirmationKeyLength = 32
+
+var (
+	ErrInvalidConfirmationToken = errors.New("invalid confirmation token")
+	ErrExpiredConfirmationToken = errors.New("confirmation token expired")
+)
+
+// EmailConfirmations signs and verifies email change confirmation tokens.
+//
+// A token is the change ID and the expiry time, with an HMAC-SHA256 signature.
+// It's derived from the change, so the same link is sent when the email is retried.
+type EmailConfirmations struct {
+	key     []byte
+	baseURL string
+	ttl     time.Duration
+}
+
+func NewEmailConfirmations(config EmailConfirmationConfig) *EmailConfirmations {
+	key := []byte(config.SigningKey)
+	if len(key) == 0 {
+		key = make([]byte, minEmailConfirmationKeyLength)
+		_, _ = rand.Read(key)
+
+		slog.Warn(
+			"EMAIL_CONFIRMATION_SIGNING_KEY is not set, email confirmation links are signed with a random key. " +
+				"They stop working when the service restarts and aren't accepted by other instances. " +
+				"Don't run it like this in production.",
+		)
+	}
+
+	return &EmailConfirmations{
+		key:     key,
+		baseURL: strings.TrimSuffix(config.BaseURL, "/"),
+		ttl:     config.TTL,
+	}
+}
+
+// ExpiresAt returns when a change requested at requestedAt expires.
+// Tokens only carry whole seconds, so it's truncated to a second.
+func (e *EmailConfirmations) ExpiresAt(requestedAt time.Time) time.Time {
+	return requestedAt.Add(e.ttl).Truncate(time.Second)
+}
+
+func (e *EmailConfirmations) Token(changeID uuid.UUID, expiresAt time.Time) string {
+	payload := make([]byte, 0, len(changeID)+8)
+	payload = append(payload, changeID.Bytes()...)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(expiresAt.Unix()))
+
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(e.sign(payload))
+}
+
+// Verify returns the change ID of a valid, unexpired token.
+func (e *EmailConfirmations) Verify(token string) (uuid.UUID, error) {
+	encodedPayload, encodedSignature, ok := strings.Cut(token, ".")
+	if !ok {
+		return uuid.Nil, ErrInvalidConfirmationToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil || len(payload) != len(uuid.UUID{})+8 {
+		return uuid.Nil, ErrInvalidConfirmationToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, e.sign(payload)) {
+		return uuid.Nil, ErrInvalidConfirmationToken
+	}
+
+	changeID, err := uuid.FromBytes(payload[:16])
+	if err != nil {
+		return uuid.Nil, ErrInvalidConfirmationToken
+	}
+
+	expiresAt := time.Unix(int64(binary.BigEndian.Uint64(payload[16:])), 0)
+	if time.Now().After(expiresAt) {
+		return uuid.Nil, ErrExpiredConfirmationToken
+	}
+
+	return changeID, nil
+}
+
+// Link returns the confirmation URL sent to the new email address.
+func (e *EmailConfirmations) Link(userID uuid.UUID, changeID uuid.UUID, expiresAt time.Time) string {
+	return fmt.Sprintf(
+		"%s/users/%s/email/confirm?token=%s",
+		e.baseURL,
+		userID,
+		url.QueryEscape(e.Token(changeID, expiresAt)),
+	)
+}
+
+func (e *EmailConfirmations) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, e.key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// EmailChangeExpirer marks email changes that weren't confirmed in time as expired,
+// and publishes UserEmailChangeExpired for each of them.
+type EmailChangeExpirer struct {
+	db       *sqlx.DB
+	outbox   *Outbox
+	interval time.Duration
+}
+
+func NewEmailChangeExpirer(db *sqlx.DB, outbox *Outbox, config EmailConfirmationConfig) *EmailChangeExpirer {
+	return &EmailChangeExpirer{
+		db:       db,
+		outbox:   outbox,
+		interval: config.ExpiryInterval,
+	}
+}
+
+func (e *EmailChangeExpirer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		expired, err := e.Expire(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.With("error", err).Error("Failed to expire email changes")
+		}
+		if expired > 0 {
+			slog.Info("Expired email changes", "expired", expired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+const emailChangeExpiryBatchSize = 100
+
+// Expire expires all pending changes past their expiry time, one batch at a time,
+// and returns the number of expired changes.
+func (e *EmailChangeExpirer) Expire(ctx context.Context) (int, error) {
+	var total int
+
+	for {
+		expired, err := e.expireBatch(ctx)
+		total += expired
+
+		if err != nil {
+			return total, err
+		}
+		if expired < emailChangeExpiryBatchSize {
+			return total, nil
+		}
+	}
+}
+
+func (e *EmailChangeExpirer) expireBatch(ctx context.Context) (int, error) {
+	var expired int
+
+	err := e.outbox.UpdateInTx(ctx, e.db, sql.LevelReadCommitted, func(ctx context.Context, tx *sqlx.Tx) error {
+		var changes []struct {
+			ID         uuid.UUID `db:"id"`
+			UserID     uuid.UUID `db:"user_id"`
+			NewEmail   string    `db:"new_email"`
+			ResolvedAt time.Time `db:"resolved_at"`
+		}
+
+		err := tx.SelectContext(ctx, &changes, `
+			WITH batch AS (
+				SELECT id
+				FROM pending_email_changes
+				WHERE status = 'pending' AND expires_at < now()
+				ORDER BY expires_at
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			UPDATE pending_email_changes c
+			SET status = 'expired', resolved_at = now()
+			FROM batch b
+			WHERE c.id = b.id
+			RETURNING c.id, c.user_id, c.new_email, c.resolved_at
+		`, emailChangeExpiryBatchSize)
+		if err != nil {
+			return fmt.Errorf("failed to expire email changes: %w", err)
+		}
+
+		for _, change := range changes {
+			event := UserEmailChangeExpired{
+				UserID:    change.UserID,
+				ChangeID:  change.ID,
+				NewEmail:  change.NewEmail,
+				ExpiredAt: change.ResolvedAt,
+			}
+			if err := e.outbox.PublishInTx(ctx, event, tx); err != nil {
+				return fmt.Errorf("failed to publish event: %w", err)
+			}
+		}
+
+		expired = len(changes)
+		return nil
+	})
+
+	return expired, err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+)
+
+func newTestEmailConfirmations(key string) *EmailConfirmations {
+	return NewEmailConfirmations(EmailConfirmationConfig{
+		SigningKey: key,
+		BaseURL:    "https://example.com/",
+		TTL:        time.Hour,
+	})
+}
+
+func TestEmailConfirmations_Verify(t *testing.T) {
+	confirmations := newTestEmailConfirmations(strings.Repeat("k", minEmailConfirmationKeyLength))
+	changeID := uuid.Must(uuid.NewV7())
+	token := confirmations.Token(changeID, confirmations.ExpiresAt(time.Now()))
+
+	payload, signature, _ := strings.Cut(token, ".")
+
+	tamperedPayload := []byte(payload)
+	tamperedPayload[0] ^= 1
+
+	otherChangeToken := confirmations.Token(uuid.Must(uuid.NewV7()), confirmations.ExpiresAt(time.Now()))
+	_, otherSignature, _ := strings.Cut(otherChangeToken, ".")
+
+	testCases := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{
+			name:  "valid",
+			token: token,
+		},
+		{
+			name:    "expired",
+			token:   confirmations.Token(changeID, time.Now().Add(-time.Second)),
+			wantErr: ErrExpiredConfirmationToken,
+		},
+		{
+			name:    "tampered_payload",
+			token:   string(tamperedPayload) + "." + signature,
+			wantErr: ErrInvalidConfirmationToken,
+		},
+		{
+			name:    "signature_of_another_change",
+			token:   payload + "." + otherSignature,
+			wantErr: ErrInvalidConfirmationToken,
+		},
+		{
+			// The signature is checked before the expiry, so it can't be extended.
+			name: "extended_expiry",
+			token: base64.RawURLEncoding.EncodeToString(
+				append(changeID.Bytes(), 0x7f, 0, 0, 0, 0, 0, 0, 0),
+			) + "." + signature,
+			wantErr: ErrInvalidConfirmationToken,
+		},
+		{
+			name:    "signed_with_another_key",
+			token:   newTestEmailConfirmations(strings.Repeat("x", minEmailConfirmationKeyLength)).Token(changeID, time.Now().Add(time.Hour)),
+			wantErr: ErrInvalidConfirmationToken,
+		},
+		{
+			name:    "without_signature",
+			token:   payload,
+			wantErr: ErrInvalidConfirmationToken,
+		},
+		{
+			name:    "short_payload",
+			token:   base64.RawURLEncoding.EncodeToString(changeID.Bytes()) + "." + signature,
+			wantErr: ErrInvalidConfirmationToken,
+		},
+		{
+			name:    "not_base64",
+			token:   "!!!." + signature,
+			wantErr: ErrInvalidConfirmationToken,
+		},
+		{
+			name:    "empty",
+			token:   "",
+			wantErr: ErrInvalidConfirmationToken,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := confirmations.Verify(tc.token)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+			}
+			if tc.wantErr == nil && got != changeID {
+				t.Errorf("expected change ID %s, got %s", changeID, got)
+			}
+		})
+	}
+}
+
+func TestEmailConfirmations_Link(t *testing.T) {
+	confirmations := newTestEmailConfirmations(strings.Repeat("k", minEmailConfirmationKeyLength))
+	userID := uuid.Must(uuid.NewV7())
+	changeID := uuid.Must(uuid.NewV7())
+	expiresAt := confirmations.ExpiresAt(time.Now())
+
+	link := confirmations.Link(userID, changeID, expiresAt)
+
+	want := "https://example.com/users/" + userID.String() + "/email/confirm?token=" + confirmations.Token(changeID, expiresAt)
+	if link != want {
+		t.Errorf("expected link %s, got %s", want, link)
+	}
+}
+
+func TestNewEmailConfirmations_withoutSigningKey(t *testing.T) {
+	confirmations := newTestEmailConfirmations("")
+	changeID := uuid.Must(uuid.NewV7())
+	token := confirmations.Token(changeID, time.Now().Add(time.Hour))
+
+	if _, err := confirmations.Verify(token); err != nil {
+		t.Fatalf("token signed with the generated key is not valid: %v", err)
+	}
+
+	// Every instance generates its own key.
+	if _, err := newTestEmailConfirmations("").Verify(token); !errors.Is(err, ErrInvalidConfirmationToken) {
+		t.Errorf("expected the token to be rejected by another instance, got %v", err)
+	}
+}
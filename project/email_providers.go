@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Email is a rendered email. HTMLBody is optional.
+type Email struct {
+	To       string
+	Subject  string
+	TextBody string
+	HTMLBody string
+}
+
+// EmailProvider sends emails for the event handlers.
+type EmailProvider interface {
+	SendEmail(ctx context.Context, email Email) error
+}
+
+type EmailProviderName string
+
+const (
+	EmailProviderGateway EmailProviderName = "gateway"
+	EmailProviderSMTP    EmailProviderName = "smtp"
+	EmailProviderFile    EmailProviderName = "file"
+)
+
+type EmailConfig struct {
+	Provider EmailProviderName `yaml:"provider"`
+
+	// From is the sender address of emails sent over SMTP or written to files.
+	From string `yaml:"from"`
+
+	SMTP SMTPConfig `yaml:"smtp"`
+
+	// Dir is where the file provider writes .eml files.
+	Dir string `yaml:"dir"`
+}
+
+type SMTPConfig struct {
+	Addr     string        `yaml:"addr"`
+	Username string        `yaml:"username"`
+	Password string        `yaml:"password"`
+	Timeout  time.Duration `yaml:"timeout"`
+
+	// RequireTLS fails sending when the server doesn't offer STARTTLS, so a connection
+	// stripped of it doesn't send credentials and emails in plain text.
+	// Disable it only for local development servers without TLS.
+	RequireTLS bool `yaml:"require_tls"`
+}
+
+func DefaultEmailConfig() EmailConfig {
+	return EmailConfig{
+		Provider: EmailProviderGateway,
+		From:     "no-reply@example.com",
+		SMTP: SMTPConfig{
+			Timeout:    10 * time.Second,
+			RequireTLS: true,
+		},
+		Dir: "emails",
+	}
+}
+
+// NewEmailProvider creates the provider selected in the config.
+func NewEmailProvider(config EmailConfig, gateway GatewayConfig) (EmailProvider, error) {
+	switch config.Provider {
+	case EmailProviderGateway:
+		return EmailSender{
+			ApiEndpoint: gateway.Addr + EmailSendPath,
+			Client:      NewGatewayClient("email", gateway.Email),
+		}, nil
+	case EmailProviderSMTP:
+		return SMTPEmailSender{
+			Config: config.SMTP,
+			From:   config.From,
+		}, nil
+	case EmailProviderFile:
+		return FileEmailSender{
+			Dir:  config.Dir,
+			From: config.From,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown email provider: %q", config.Provider)
+	}
+}
+
+// SMTPEmailSender sends emails to an SMTP server. STARTTLS is used when the server supports it,
+// and required unless Config.RequireTLS is disabled.
+type SMTPEmailSender struct {
+	Config SMTPConfig
+	From   string
+
+	// TLSConfig is used for STARTTLS, by default the server certificate is verified with the system roots.
+	// The server name is always the host from Config.Addr.
+	TLSConfig *tls.Config
+}
+
+func (s SMTPEmailSender) SendEmail(ctx context.Context, email Email) (err error) {
+	ctx, span := tracer().Start(ctx, "SMTPEmailSender.SendEmail", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		observeGatewayCall("smtp", err)
+		endSpan(span, err)
+	}()
+
+	msg, err := buildEmailMessage(s.From, email)
+	if err != nil {
+		return &GatewayError{Gateway: "smtp", Err: err}
+	}
+
+	from, _ := mail.ParseAddress(s.From)
+	to, _ := mail.ParseAddress(email.To)
+
+	if err := s.send(ctx, from.Address, to.Address, msg); err != nil {
+		var smtpErr *textproto.Error
+		if errors.As(err, &smtpErr) {
+			// 5xx replies are permanent failures, like an unknown recipient.
+			return &GatewayError{Gateway: "smtp", StatusCode: smtpErr.Code, Retryable: smtpErr.Code < 500, Err: err}
+		}
+		return &GatewayError{Gateway: "smtp", Retryable: true, Err: err}
+	}
+
+	return nil
+}
+
+func (s SMTPEmailSender) send(ctx context.Context, from string, to string, msg []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.Config.Timeout)
+	defer cancel()
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Config.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to SMTP server: %w", err)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+
+	host, _, err := net.SplitHostPort(s.Config.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP address: %w", err)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	startTLS, _ := client.Extension("STARTTLS")
+	if !startTLS && s.Config.RequireTLS {
+		return errors.New("SMTP server doesn't offer STARTTLS, and TLS is required")
+	}
+
+	if startTLS {
+		tlsConfig := &tls.Config{}
+		if s.TLSConfig != nil {
+			tlsConfig = s.TLSConfig.Clone()
+		}
+		tlsConfig.ServerName = host
+
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("failed to start TLS: %w", err)
+		}
+	}
+
+	if s.Config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.Config.Username, s.Config.Password, host)); err != nil {
+			return fmt.Errorf("failed to authenticate: %w", err)
+		}
+	}
+
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// FileEmailSender writes each email to an .eml file in Dir, for local development.
+type FileEmailSender struct {
+	Dir  string
+	From string
+}
+
+func (f FileEmailSender) SendEmail(ctx context.Context, email Email) error {
+	msg, err := buildEmailMessage(f.From, email)
+	if err != nil {
+		return &GatewayError{Gateway: "file", Err: err}
+	}
+
+	if err := os.MkdirAll(f.Dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create email directory: %w", err)
+	}
+
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405.000Z"), watermill.NewShortUUID())
+	if err := os.WriteFile(filepath.Join(f.Dir, name), msg, 0o644); err != nil {
+		return fmt.Errorf("failed to write email: %w", err)
+	}
+
+	return nil
+}
+
+// buildEmailMessage formats an RFC 5322 message, multipart/alternative when the email has an HTML body.
+func buildEmailMessage(from string, email Email) ([]byte, error) {
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender address: %w", err)
+	}
+	toAddr, err := mail.ParseAddress(email.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient address: %w", err)
+	}
+
+	var buf bytes.Buffer
+
+	headers := [][2]string{
+		{"From", fromAddr.String()},
+		{"To", toAddr.String()},
+		{"Subject", mime.QEncoding.Encode("utf-8", email.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", fmt.Sprintf("<%s@%s>", watermill.NewUUID(), fromAddr.Address[strings.LastIndex(fromAddr.Address, "@")+1:])},
+		{"MIME-Version", "1.0"},
+	}
+
+	if email.HTMLBody == "" {
+		headers = append(headers,
+			[2]string{"Content-Type", "text/plain; charset=utf-8"},
+			[2]string{"Content-Transfer-Encoding", "quoted-printable"},
+		)
+		writeEmailHeaders(&buf, headers)
+
+		if err := writeQuotedPrintable(&buf, email.TextBody); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	// The parts are written first, so the boundary is known when writing the headers.
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	// Clients show the last part they support, so the HTML part goes last.
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", email.TextBody},
+		{"text/html; charset=utf-8", email.HTMLBody},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	headers = append(headers, [2]string{"Content-Type", "multipart/alternative; boundary=" + mw.Boundary()})
+	writeEmailHeaders(&buf, headers)
+	buf.Write(body.Bytes())
+
+	return buf.Bytes(), nil
+}
+
+func writeEmailHeaders(w io.Writer, headers [][2]string) {
+	for _, h := range headers {
+		fmt.Fprintf(w, "%s: %s\r\n", h[0], h[1])
+	}
+	fmt.Fprint(w, "\r\n")
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSMTPEmailSender_startTLS(t *testing.T) {
+	cert, roots := newTestCertificate(t)
+	server := newFakeSMTPServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	sender := SMTPEmailSender{
+		Config: SMTPConfig{
+			Addr:     server.Addr(),
+			Username: "user",
+			Password: "secret",
+			Timeout:  5 * time.Second,
+		},
+		From: "Our Website <no-reply@example.com>",
+		// The server name isn't set, it must be taken from the address.
+		TLSConfig: &tls.Config{RootCAs: roots},
+	}
+
+	err := sender.SendEmail(context.Background(), Email{
+		To:       "user@example.com",
+		Subject:  "Welcome to our website!",
+		TextBody: "Hello",
+		HTMLBody: "<p>Hello</p>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	emails := server.Emails()
+	if len(emails) != 1 {
+		t.Fatalf("expected 1 email, got %d", len(emails))
+	}
+	email := emails[0]
+
+	if !email.TLS {
+		t.Error("email was sent without TLS")
+	}
+	if email.Auth != "\x00user\x00secret" {
+		t.Errorf("unexpected credentials %q", email.Auth)
+	}
+	if email.From != "no-reply@example.com" {
+		t.Errorf("unexpected sender %q", email.From)
+	}
+	if len(email.To) != 1 || email.To[0] != "user@example.com" {
+		t.Errorf("unexpected recipients %v", email.To)
+	}
+	for _, s := range []string{"Subject: Welcome to our website!", "multipart/alternative", "<p>Hello</p>"} {
+		if !strings.Contains(email.Data, s) {
+			t.Errorf("message doesn't contain %q:\n%s", s, email.Data)
+		}
+	}
+}
+
+func TestSMTPEmailSender_untrustedCertificate(t *testing.T) {
+	cert, _ := newTestCertificate(t)
+	server := newFakeSMTPServer(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	sender := SMTPEmailSender{
+		Config: SMTPConfig{Addr: server.Addr(), Timeout: 5 * time.Second},
+		From:   "no-reply@example.com",
+	}
+
+	err := sender.SendEmail(context.Background(), Email{To: "user@example.com", Subject: "Hi", TextBody: "Hello"})
+
+	var certErr *tls.CertificateVerificationError
+	if !errors.As(err, &certErr) {
+		t.Fatalf("expected a certificate verification error, got %v", err)
+	}
+	if !IsRetryable(err) {
+		t.Error("expected a retryable error")
+	}
+	if n := len(server.Emails()); n != 0 {
+		t.Errorf("expected no emails, got %d", n)
+	}
+}
+
+func TestSMTPEmailSender_withoutStartTLS(t *testing.T) {
+	testCases := []struct {
+		name       string
+		requireTLS bool
+		wantSent   bool
+	}{
+		{name: "tls_required", requireTLS: true, wantSent: false},
+		{name: "tls_optional", requireTLS: false, wantSent: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newFakeSMTPServer(t, nil)
+
+			sender := SMTPEmailSender{
+				Config: SMTPConfig{
+					Addr:       server.Addr(),
+					Username:   "user",
+					Password:   "secret",
+					Timeout:    5 * time.Second,
+					RequireTLS: tc.requireTLS,
+				},
+				From: "no-reply@example.com",
+			}
+
+			err := sender.SendEmail(context.Background(), Email{To: "user@example.com", Subject: "Hi", TextBody: "Hello"})
+			if tc.wantSent && err != nil {
+				t.Fatal(err)
+			}
+			if !tc.wantSent && err == nil {
+				t.Fatal("expected an error when the server doesn't offer STARTTLS")
+			}
+
+			emails := server.Emails()
+			if !tc.wantSent {
+				if len(emails) != 0 {
+					t.Errorf("expected no emails, got %d", len(emails))
+				}
+				return
+			}
+			if len(emails) != 1 {
+				t.Fatalf("expected 1 email, got %d", len(emails))
+			}
+			if emails[0].TLS {
+				t.Error("expected the email to be sent without TLS")
+			}
+		})
+	}
+}
+
+func TestSMTPEmailSender_rejectedRecipient(t *testing.T) {
+	testCases := []struct {
+		name          string
+		code          int
+		wantRetryable bool
+	}{
+		{name: "permanent", code: 550, wantRetryable: false},
+		{name: "temporary", code: 450, wantRetryable: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newFakeSMTPServer(t, nil)
+			server.rejectRecipients = map[string]int{"unknown@example.com": tc.code}
+
+			sender := SMTPEmailSender{
+				Config: SMTPConfig{Addr: server.Addr(), Timeout: 5 * time.Second},
+				From:   "no-reply@example.com",
+			}
+
+			err := sender.SendEmail(context.Background(), Email{To: "unknown@example.com", Subject: "Hi", TextBody: "Hello"})
+
+			var gatewayErr *GatewayError
+			if !errors.As(err, &gatewayErr) {
+				t.Fatalf("expected a GatewayError, got %v", err)
+			}
+			if gatewayErr.StatusCode != tc.code {
+				t.Errorf("expected status %d, got %d", tc.code, gatewayErr.StatusCode)
+			}
+			if IsRetryable(err) != tc.wantRetryable {
+				t.Errorf("expected retryable %v, got %v", tc.wantRetryable, IsRetryable(err))
+			}
+		})
+	}
+}
+
+func TestFileEmailSender(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "emails")
+
+	sender := FileEmailSender{Dir: dir, From: "no-reply@example.com"}
+
+	err := sender.SendEmail(context.Background(), Email{To: "user@example.com", Subject: "Hi", TextBody: "Hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %v", files)
+	}
+
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"From: <no-reply@example.com>", "To: <user@example.com>", "Subject: Hi", "Hello"} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("message doesn't contain %q:\n%s", s, data)
+		}
+	}
+}
+
+// fakeSMTPServer is an SMTP server that keeps the emails it receives in memory.
+// STARTTLS is supported when it has a TLS config.
+type fakeSMTPServer struct {
+	listener  net.Listener
+	tlsConfig *tls.Config
+
+	// rejectRecipients maps addresses to the reply code of RCPT.
+	rejectRecipients map[string]int
+
+	mu     sync.Mutex
+	emails []receivedEmail
+}
+
+type receivedEmail struct {
+	From string
+	To   []string
+	Data string
+	TLS  bool
+	// Auth is the decoded AUTH PLAIN response.
+	Auth string
+}
+
+func newFakeSMTPServer(t *testing.T, tlsConfig *tls.Config) *fakeSMTPServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	s := &fakeSMTPServer{
+		listener:  listener,
+		tlsConfig: tlsConfig,
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *fakeSMTPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeSMTPServer) Emails() []receivedEmail {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]receivedEmail(nil), s.emails...)
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	_ = text.PrintfLine("220 localhost ESMTP")
+
+	var email receivedEmail
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(line, " ")
+
+		switch strings.ToUpper(command) {
+		case "EHLO", "HELO":
+			extensions := []string{"localhost", "AUTH PLAIN"}
+			if s.tlsConfig != nil && !email.TLS {
+				extensions = append(extensions, "STARTTLS")
+			}
+			for i, extension := range extensions {
+				separator := "-"
+				if i == len(extensions)-1 {
+					separator = " "
+				}
+				_ = text.PrintfLine("250%s%s", separator, extension)
+			}
+		case "STARTTLS":
+			_ = text.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			text = textproto.NewConn(tlsConn)
+			email = receivedEmail{TLS: true}
+		case "AUTH":
+			_, response, _ := strings.Cut(arg, " ")
+			decoded, err := base64.StdEncoding.DecodeString(response)
+			if err != nil {
+				_ = text.PrintfLine("501 Invalid response")
+				continue
+			}
+			email.Auth = string(decoded)
+			_ = text.PrintfLine("235 Authentication successful")
+		case "MAIL":
+			email.From = smtpPathAddress(arg)
+			_ = text.PrintfLine("250 OK")
+		case "RCPT":
+			address := smtpPathAddress(arg)
+			if code, ok := s.rejectRecipients[address]; ok {
+				_ = text.PrintfLine("%d Recipient rejected", code)
+				continue
+			}
+			email.To = append(email.To, address)
+			_ = text.PrintfLine("250 OK")
+		case "DATA":
+			_ = text.PrintfLine("354 Send the message")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			email.Data = string(data)
+
+			s.mu.Lock()
+			s.emails = append(s.emails, email)
+			s.mu.Unlock()
+
+			email = receivedEmail{TLS: email.TLS, Auth: email.Auth}
+			_ = text.PrintfLine("250 OK")
+		case "QUIT":
+			_ = text.PrintfLine("221 Bye")
+			return
+		default:
+			_ = text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// smtpPathAddress returns the address from the argument of MAIL or RCPT, like "FROM:<user@example.com>".
+func smtpPathAddress(arg string) string {
+	_, address, _ := strings.Cut(arg, "<")
+	address, _, _ = strings.Cut(address, ">")
+	return address
+}
+
+// newTestCertificate returns a self-signed certificate for 127.0.0.1 and a pool that trusts it.
+func newTestCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
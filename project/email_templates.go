@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// Each email type has a subject, a plain text and an HTML template in every locale directory,
+// like email_templates/en/welcome.subject.tmpl. HTML templates define "content",
+// which is rendered inside email_templates/layout.html.tmpl.
+//
+//go:embed email_templates
+var emailTemplateFiles embed.FS
+
+type EmailType string
+
+const (
+	EmailWelcome            EmailType = "welcome"
+	EmailConfirmEmailChange EmailType = "confirm_email_change"
+	EmailNotifyEmailChange  EmailType = "notify_email_change"
+)
+
+var emailTypes = []EmailType{
+	EmailWelcome,
+	EmailConfirmEmailChange,
+	EmailNotifyEmailChange,
+}
+
+// DefaultLocale is used for users without a supported locale, and for events published before users had one.
+const DefaultLocale = "en"
+
+var supportedLocales = []string{"en", "pl"}
+
+// NormalizeLocale returns the supported locale for a tag like "pl" or "pl-PL".
+func NormalizeLocale(locale string) (string, bool) {
+	locale = strings.ToLower(locale)
+	if i := strings.IndexAny(locale, "-_"); i >= 0 {
+		locale = locale[:i]
+	}
+
+	for _, supported := range supportedLocales {
+		if locale == supported {
+			return supported, true
+		}
+	}
+	return "", false
+}
+
+type WelcomeEmailData struct {
+	Name string
+}
+
+type ConfirmEmailChangeData struct {
+	ConfirmURL string
+	ExpiresAt  time.Time
+}
+
+type NotifyEmailChangeData struct {
+	NewEmail string
+}
+
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+// EmailTemplates renders emails from the embedded templates.
+type EmailTemplates struct {
+	templates map[string]map[EmailType]emailTemplate
+}
+
+// NewEmailTemplates parses all templates, so a missing or broken one fails at startup.
+func NewEmailTemplates() (*EmailTemplates, error) {
+	t := &EmailTemplates{
+		templates: map[string]map[EmailType]emailTemplate{},
+	}
+
+	for _, locale := range supportedLocales {
+		t.templates[locale] = map[EmailType]emailTemplate{}
+
+		for _, emailType := range emailTypes {
+			tmpl, err := parseEmailTemplate(locale, emailType)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s email template for locale %s: %w", emailType, locale, err)
+			}
+			t.templates[locale][emailType] = tmpl
+		}
+	}
+
+	return t, nil
+}
+
+func parseEmailTemplate(locale string, emailType EmailType) (emailTemplate, error) {
+	path := fmt.Sprintf("email_templates/%s/%s", locale, emailType)
+
+	subject, err := texttemplate.ParseFS(emailTemplateFiles, path+".subject.tmpl")
+	if err != nil {
+		return emailTemplate{}, err
+	}
+	text, err := texttemplate.ParseFS(emailTemplateFiles, path+".txt.tmpl")
+	if err != nil {
+		return emailTemplate{}, err
+	}
+	html, err := htmltemplate.ParseFS(emailTemplateFiles, "email_templates/layout.html.tmpl", path+".html.tmpl")
+	if err != nil {
+		return emailTemplate{}, err
+	}
+
+	return emailTemplate{
+		subject: subject.Option("missingkey=error"),
+		text:    text.Option("missingkey=error"),
+		html:    html.Option("missingkey=error"),
+	}, nil
+}
+
+// Render renders an email in the locale, falling back to DefaultLocale.
+func (t *EmailTemplates) Render(emailType EmailType, locale string, to string, data any) (Email, error) {
+	locale, ok := NormalizeLocale(locale)
+	if !ok {
+		locale = DefaultLocale
+	}
+
+	tmpl, ok := t.templates[locale][emailType]
+	if !ok {
+		return Email{}, fmt.Errorf("unknown email type: %s", emailType)
+	}
+
+	var subject, text, html bytes.Buffer
+
+	if err := tmpl.subject.Execute(&subject, data); err != nil {
+		return Email{}, fmt.Errorf("failed to render subject of %s email: %w", emailType, err)
+	}
+	if err := tmpl.text.Execute(&text, data); err != nil {
+		return Email{}, fmt.Errorf("failed to render text of %s email: %w", emailType, err)
+	}
+
+	layoutData := struct {
+		Locale  string
+		Subject string
+		Data    any
+	}{
+		Locale:  locale,
+		Subject: strings.TrimSpace(subject.String()),
+		Data:    data,
+	}
+	if err := tmpl.html.ExecuteTemplate(&html, "layout", layoutData); err != nil {
+		return Email{}, fmt.Errorf("failed to render HTML of %s email: %w", emailType, err)
+	}
+
+	return Email{
+		To:       to,
+		Subject:  layoutData.Subject,
+		TextBody: text.String(),
+		HTMLBody: html.String(),
+	}, nil
+}
+
+// Mailer renders emails from templates and sends them with the configured provider.
+type Mailer struct {
+	provider  EmailProvider
+	templates *EmailTemplates
+}
+
+func NewMailer(provider EmailProvider, templates *EmailTemplates) *Mailer {
+	return &Mailer{
+		provider:  provider,
+		templates: templates,
+	}
+}
+
+func (m *Mailer) Send(ctx context.Context, emailType EmailType, locale string, to string, data any) error {
+	email, err := m.templates.Render(emailType, locale, to, data)
+	if err != nil {
+		return err
+	}
+
+	return m.provider.SendEmail(ctx, email)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files in testdata")
+
+// testEmailData has the data rendered in the golden files of each email type.
+var testEmailData = map[EmailType]any{
+	EmailWelcome: WelcomeEmailData{
+		Name: "Jane <Doe>",
+	},
+	EmailConfirmEmailChange: ConfirmEmailChangeData{
+		ConfirmURL: "https://example.com/users/0190b6e4-7c4a-7d6b-9d4e-1f2a3b4c5d6e/email/confirm?token=abc&x=1",
+		ExpiresAt:  time.Date(2026, 1, 2, 15, 4, 5, 0, time.FixedZone("CET", 3600)),
+	},
+	EmailNotifyEmailChange: NotifyEmailChangeData{
+		NewEmail: "new@example.com",
+	},
+}
+
+func TestEmailTemplates_golden(t *testing.T) {
+	templates, err := NewEmailTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, locale := range supportedLocales {
+		for _, emailType := range emailTypes {
+			t.Run(locale+"/"+string(emailType), func(t *testing.T) {
+				data, ok := testEmailData[emailType]
+				if !ok {
+					t.Fatalf("no test data for %s emails", emailType)
+				}
+
+				email, err := templates.Render(emailType, locale, "user@example.com", data)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got := formatGoldenEmail(email)
+				path := filepath.Join("testdata", "golden", "emails", locale, string(emailType)+".golden")
+
+				if *updateGolden {
+					if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				want, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatalf("%v, run the tests with -update to create it", err)
+				}
+				if got != string(want) {
+					t.Errorf("email doesn't match %s, run the tests with -update if the change is intended\ngot:\n%s\nwant:\n%s", path, got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestEmailTemplates_Render_locale(t *testing.T) {
+	templates, err := NewEmailTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		locale     string
+		wantLocale string
+	}{
+		// Events published before users had a locale.
+		{locale: "", wantLocale: DefaultLocale},
+		{locale: "de", wantLocale: DefaultLocale},
+		{locale: "pl-PL", wantLocale: "pl"},
+		{locale: "PL", wantLocale: "pl"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.locale, func(t *testing.T) {
+			data := testEmailData[EmailWelcome]
+
+			got, err := templates.Render(EmailWelcome, tc.locale, "user@example.com", data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := templates.Render(EmailWelcome, tc.wantLocale, "user@example.com", data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != want {
+				t.Errorf("expected the email in %s, got:\n%s", tc.wantLocale, formatGoldenEmail(got))
+			}
+		})
+	}
+}
+
+func formatGoldenEmail(email Email) string {
+	return "To: " + email.To + "\n" +
+		"Subject: " + email.Subject + "\n" +
+		"\n-- text --\n" + email.TextBody +
+		"\n-- html --\n" + email.HTMLBody
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AppError is an error that is safe to show to API clients.
+// echoErrorHandler renders it as an RFC 7807 problem, any other error becomes a 500.
+type AppError struct {
+	Status  int
+	Code    string
+	Message string
+	Details []FieldError
+
+	// Err is the underlying cause. It's logged, but never sent to the client.
+	Err error
+}
+
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *AppError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *AppError) Unwrap() error {
+	return e.Err
+}
+
+func NewBadRequestError(code string, message string, err error) *AppError {
+	return &AppError{
+		Status:  http.StatusBadRequest,
+		Code:    code,
+		Message: message,
+		Err:     err,
+	}
+}
+
+func NewValidationError(details ...FieldError) *AppError {
+	return &AppError{
+		Status:  http.StatusBadRequest,
+		Code:    "validation_failed",
+		Message: "request is not valid",
+		Details: details,
+	}
+}
+
+func NewUnauthorizedError(code string, message string) *AppError {
+	return &AppError{
+		Status:  http.StatusUnauthorized,
+		Code:    code,
+		Message: message,
+	}
+}
+
+func NewNotFoundError(code string, message string) *AppError {
+	return &AppError{
+		Status:  http.StatusNotFound,
+		Code:    code,
+		Message: message,
+	}
+}
+
+func NewConflictError(code string, message string, details ...FieldError) *AppError {
+	return &AppError{
+		Status:  http.StatusConflict,
+		Code:    code,
+		Message: message,
+		Details: details,
+	}
+}
+
+func NewUnprocessableError(code string, message string, details ...FieldError) *AppError {
+	return &AppError{
+		Status:  http.StatusUnprocessableEntity,
+		Code:    code,
+		Message: message,
+		Details: details,
+	}
+}
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details body, extended with our error code and field errors.
+type Problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Code   string       `json:"code"`
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+func newProblem(err *AppError) Problem {
+	return Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(err.Status),
+		Status: err.Status,
+		Detail: err.Message,
+		Code:   err.Code,
+		Errors: err.Details,
+	}
+}
+
+// statusCode turns an HTTP status into an error code, for example 404 becomes "not_found".
+func statusCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	return strings.ReplaceAll(strings.ToLower(text), " ", "_")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestStatusCode(t *testing.T) {
+	testCases := map[int]string{
+		http.StatusNotFound:            "not_found",
+		http.StatusMethodNotAllowed:    "method_not_allowed",
+		http.StatusUnprocessableEntity: "unprocessable_entity",
+		http.StatusTooManyRequests:     "too_many_requests",
+		599:                            "error",
+	}
+
+	for status, want := range testCases {
+		if got := statusCode(status); got != want {
+			t.Errorf("statusCode(%d): expected %q, got %q", status, want, got)
+		}
+	}
+}
+
+func TestAppError(t *testing.T) {
+	cause := errors.New("invalid character")
+	err := fmt.Errorf("failed to bind: %w", NewBadRequestError("invalid_request", "request body is not valid", cause))
+
+	var appErr *AppError
+	if !errors.As(err, &appErr) {
+		t.Fatal("expected an AppError")
+	}
+	if appErr.Status != http.StatusBadRequest {
+		t.Errorf("expected status %d, got %d", http.StatusBadRequest, appErr.Status)
+	}
+	if !errors.Is(err, cause) {
+		t.Error("expected the cause to be unwrapped")
+	}
+
+	// The cause is logged, but not sent to the client.
+	problem := newProblem(appErr)
+	if problem.Detail != "request body is not valid" {
+		t.Errorf("expected the message as the detail, got %q", problem.Detail)
+	}
+}
+
+func TestEchoErrorHandler_committed(t *testing.T) {
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+
+	if err := c.String(http.StatusOK, "partial response"); err != nil {
+		t.Fatal(err)
+	}
+	echoErrorHandler(errors.New("failed after writing"), c)
+
+	if rec.Code != http.StatusOK || rec.Body.String() != "partial response" {
+		t.Errorf("expected the written response to be kept, got %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -10,24 +10,68 @@ type UserRegistered struct {
 	UserID       uuid.UUID `json:"user_id"`
 	Name         string    `json:"name"`
 	Email        string    `json:"email"`
+	Locale       string    `json:"locale"`
 	RegisteredAt time.Time `json:"registered_at"`
 }
 
+// UserEmailChangeRequested is published when a user asks to change their email.
+// The change is applied once the new address is confirmed.
+type UserEmailChangeRequested struct {
+	UserID      uuid.UUID `json:"user_id"`
+	ChangeID    uuid.UUID `json:"change_id"`
+	NewEmail    string    `json:"new_email"`
+	OldEmail    string    `json:"old_email"`
+	Locale      string    `json:"locale"`
+	RequestedAt time.Time `json:"requested_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// UserEmailUpdated was published when a user's email was changed without a confirmation.
+// It's no longer published, but it's still handled, so messages published before are not lost.
 type UserEmailUpdated struct {
 	UserID    uuid.UUID `json:"user_id"`
 	NewEmail  string    `json:"new_email"`
 	OldEmail  string    `json:"old_email"`
+	Locale    string    `json:"locale"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+type UserEmailConfirmed struct {
+	UserID      uuid.UUID `json:"user_id"`
+	ChangeID    uuid.UUID `json:"change_id"`
+	NewEmail    string    `json:"new_email"`
+	OldEmail    string    `json:"old_email"`
+	Locale      string    `json:"locale"`
+	ConfirmedAt time.Time `json:"confirmed_at"`
+}
+
+type UserEmailChangeExpired struct {
+	UserID    uuid.UUID `json:"user_id"`
+	ChangeID  uuid.UUID `json:"change_id"`
+	NewEmail  string    `json:"new_email"`
+	ExpiredAt time.Time `json:"expired_at"`
+}
+
 type Event interface {
 	PartitionKey() string
 }
 
+func (u UserEmailChangeRequested) PartitionKey() string {
+	return u.UserID.String()
+}
+
 func (u UserEmailUpdated) PartitionKey() string {
 	return u.UserID.String()
 }
 
+func (u UserEmailConfirmed) PartitionKey() string {
+	return u.UserID.String()
+}
+
+func (u UserEmailChangeExpired) PartitionKey() string {
+	return u.UserID.String()
+}
+
 func (u UserRegistered) PartitionKey() string {
 	return u.UserID.String()
 }
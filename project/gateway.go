@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type GatewayClientConfig struct {
+	// Timeout limits each attempt, not the whole call with retries.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Failed attempts are retried up to MaxRetries times, on network errors, 5xx and 429 responses.
+	// The backoff between retries grows from InitialBackoff to MaxBackoff, unless the gateway sends Retry-After,
+	// which is used up to MaxBackoff.
+	MaxRetries     int           `yaml:"max_retries"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+
+	// After BreakerFailures consecutive failed calls, calls fail fast for BreakerOpenTimeout,
+	// then a single call is let through to check if the gateway is back.
+	BreakerFailures    int           `yaml:"breaker_failures"`
+	BreakerOpenTimeout time.Duration `yaml:"breaker_open_timeout"`
+}
+
+func DefaultGatewayClientConfig() GatewayClientConfig {
+	return GatewayClientConfig{
+		Timeout:            5 * time.Second,
+		MaxRetries:         3,
+		InitialBackoff:     200 * time.Millisecond,
+		MaxBackoff:         5 * time.Second,
+		BreakerFailures:    5,
+		BreakerOpenTimeout: 30 * time.Second,
+	}
+}
+
+// ErrCircuitOpen is returned without calling the gateway while it's considered down.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// GatewayError is returned by GatewayClient calls.
+// Retryable tells whether the same call may succeed later.
+type GatewayError struct {
+	Gateway    string
+	StatusCode int
+	Retryable  bool
+	Err        error
+}
+
+func (e *GatewayError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s gateway returned status %d: %v", e.Gateway, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("%s gateway call failed: %v", e.Gateway, e.Err)
+}
+
+func (e *GatewayError) Unwrap() error {
+	return e.Err
+}
+
+// IsRetryable reports whether a failed call may succeed if it's repeated.
+// Errors that don't say otherwise are retryable.
+func IsRetryable(err error) bool {
+	var gatewayErr *GatewayError
+	if errors.As(err, &gatewayErr) {
+		return gatewayErr.Retryable
+	}
+	return true
+}
+
+// GatewayClient calls one gateway API with per-attempt timeouts, retries and a circuit breaker.
+type GatewayClient struct {
+	name       string
+	config     GatewayClientConfig
+	httpClient *http.Client
+	breaker    *circuitBreaker
+}
+
+func NewGatewayClient(name string, config GatewayClientConfig) *GatewayClient {
+	return &GatewayClient{
+		name:       name,
+		config:     config,
+		httpClient: &http.Client{Timeout: config.Timeout},
+		breaker:    newCircuitBreaker(name, config.BreakerFailures, config.BreakerOpenTimeout),
+	}
+}
+
+// GatewayRequest is a JSON POST to a gateway. Every retry sends the same body and headers.
+type GatewayRequest struct {
+	URL    string
+	Header http.Header
+	Body   any
+
+	// Response, if set, is decoded from the JSON body of a successful response.
+	Response any
+}
+
+// PostJSON sends body as JSON and expects a 2xx response.
+func (c *GatewayClient) PostJSON(ctx context.Context, url string, body any) error {
+	return c.Post(ctx, GatewayRequest{URL: url, Body: body})
+}
+
+func (c *GatewayClient) Post(ctx context.Context, req GatewayRequest) error {
+	jsonBody, err := json.Marshal(req.Body)
+	if err != nil {
+		return &GatewayError{Gateway: c.name, Err: fmt.Errorf("failed to marshal request: %w", err)}
+	}
+
+	if !c.breaker.Allow() {
+		return &GatewayError{Gateway: c.name, Retryable: true, Err: ErrCircuitOpen}
+	}
+
+	err = c.postWithRetries(ctx, req, jsonBody)
+	c.breaker.Record(err)
+
+	return err
+}
+
+func (c *GatewayClient) postWithRetries(ctx context.Context, req GatewayRequest, jsonBody []byte) error {
+	backoff := c.config.InitialBackoff
+
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := c.post(ctx, req, jsonBody)
+		if err == nil {
+			return nil
+		}
+		if !err.Retryable || attempt >= c.config.MaxRetries {
+			return err
+		}
+
+		// Retry-After is capped, a long one would block the handler and its transaction.
+		wait := min(retryAfter, c.config.MaxBackoff)
+		if wait == 0 {
+			wait = backoff/2 + rand.N(backoff/2+1)
+			backoff = min(backoff*2, c.config.MaxBackoff)
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return err
+		}
+
+		slog.With("error", err, "gateway", c.name, "attempt", attempt+1, "wait", wait.String()).
+			WarnContext(ctx, "Gateway call failed, retrying")
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// post makes a single attempt. It returns the Retry-After delay sent by the gateway, if any.
+func (c *GatewayClient) post(ctx context.Context, gatewayReq GatewayRequest, jsonBody []byte) (time.Duration, *GatewayError) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, gatewayReq.URL, bytes.NewReader(jsonBody))
+	if err != nil {
+		return 0, &GatewayError{Gateway: c.name, Err: fmt.Errorf("failed to create request: %w", err)}
+	}
+
+	for key, values := range gatewayReq.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setCorrelationIDHeader(ctx, req)
+	injectTraceHeaders(ctx, req)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, &GatewayError{Gateway: c.name, Retryable: true, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if gatewayReq.Response == nil {
+			return 0, nil
+		}
+		// A successful response that can't be read is retried, the request is expected to be idempotent.
+		if err := json.NewDecoder(resp.Body).Decode(gatewayReq.Response); err != nil {
+			return 0, &GatewayError{
+				Gateway:    c.name,
+				StatusCode: resp.StatusCode,
+				Retryable:  true,
+				Err:        fmt.Errorf("failed to decode response: %w", err),
+			}
+		}
+		return 0, nil
+	}
+
+	message := http.StatusText(resp.StatusCode)
+	if respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)); len(bytes.TrimSpace(respBody)) > 0 {
+		message = string(bytes.TrimSpace(respBody))
+	}
+
+	return parseRetryAfter(resp.Header.Get("Retry-After")), &GatewayError{
+		Gateway:    c.name,
+		StatusCode: resp.StatusCode,
+		Retryable:  isRetryableStatus(resp.StatusCode),
+		Err:        errors.New(message),
+	}
+}
+
+func isRetryableStatus(status int) bool {
+	return status >= http.StatusInternalServerError ||
+		status == http.StatusTooManyRequests ||
+		status == http.StatusRequestTimeout
+}
+
+// parseRetryAfter supports both forms of the header: delay in seconds and an HTTP date.
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// circuitBreaker opens after a number of consecutive failures. While open, calls fail fast.
+// After the open timeout, one call is let through: it closes the breaker on success and opens it again on failure.
+type circuitBreaker struct {
+	name        string
+	maxFailures int
+	openTimeout time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func newCircuitBreaker(name string, maxFailures int, openTimeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		name:        name,
+		maxFailures: maxFailures,
+		openTimeout: openTimeout,
+	}
+}
+
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures < b.maxFailures {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+
+	b.probing = true
+	return true
+}
+
+// Record counts the result of an allowed call. Non-retryable errors mean the gateway is up,
+// so they don't count as failures.
+func (b *circuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wasProbing := b.probing
+	b.probing = false
+
+	if err == nil || !IsRetryable(err) {
+		if b.failures >= b.maxFailures {
+			slog.Info("Gateway circuit breaker closed", "gateway", b.name)
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.maxFailures {
+		b.openUntil = time.Now().Add(b.openTimeout)
+		if !wasProbing {
+			slog.With("error", err, "gateway", b.name, "open_for", b.openTimeout.String()).Warn("Gateway circuit breaker opened")
+		}
+	}
+}
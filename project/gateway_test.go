@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testGatewayClientConfig() GatewayClientConfig {
+	return GatewayClientConfig{
+		Timeout:            time.Second,
+		MaxRetries:         3,
+		InitialBackoff:     time.Millisecond,
+		MaxBackoff:         10 * time.Millisecond,
+		BreakerFailures:    5,
+		BreakerOpenTimeout: time.Minute,
+	}
+}
+
+// newTestGateway responds with the statuses in order, and with the last one after that.
+func newTestGateway(t *testing.T, header http.Header, statuses ...int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := int(calls.Add(1))
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(statuses[min(call, len(statuses))-1])
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &calls
+}
+
+func TestGatewayClient_Post(t *testing.T) {
+	testCases := []struct {
+		name              string
+		statuses          []int
+		expectedCalls     int32
+		expectedErr       bool
+		expectedRetryable bool
+	}{
+		{
+			name:          "success",
+			statuses:      []int{http.StatusOK},
+			expectedCalls: 1,
+		},
+		{
+			name:          "retried until success",
+			statuses:      []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			expectedCalls: 3,
+		},
+		{
+			name:              "retries exhausted",
+			statuses:          []int{http.StatusInternalServerError},
+			expectedCalls:     4,
+			expectedErr:       true,
+			expectedRetryable: true,
+		},
+		{
+			name:              "client error is not retried",
+			statuses:          []int{http.StatusBadRequest},
+			expectedCalls:     1,
+			expectedErr:       true,
+			expectedRetryable: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server, calls := newTestGateway(t, nil, tc.statuses...)
+			client := NewGatewayClient("test", testGatewayClientConfig())
+
+			err := client.PostJSON(context.Background(), server.URL, map[string]string{"key": "value"})
+
+			if calls.Load() != tc.expectedCalls {
+				t.Errorf("expected %d calls, got %d", tc.expectedCalls, calls.Load())
+			}
+			if (err != nil) != tc.expectedErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err != nil && IsRetryable(err) != tc.expectedRetryable {
+				t.Errorf("expected retryable %v, got %v", tc.expectedRetryable, IsRetryable(err))
+			}
+		})
+	}
+}
+
+func TestGatewayClient_Post_retryAfterIsCapped(t *testing.T) {
+	server, calls := newTestGateway(
+		t,
+		http.Header{"Retry-After": {"3600"}},
+		http.StatusTooManyRequests,
+		http.StatusOK,
+	)
+	client := NewGatewayClient("test", testGatewayClientConfig())
+
+	start := time.Now()
+	if err := client.PostJSON(context.Background(), server.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("retry waited %s, expected at most the max backoff", elapsed)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected 2 calls, got %d", calls.Load())
+	}
+}
+
+func TestGatewayClient_Post_circuitBreaker(t *testing.T) {
+	server, calls := newTestGateway(t, nil, http.StatusServiceUnavailable)
+
+	config := testGatewayClientConfig()
+	config.MaxRetries = 0
+	config.BreakerFailures = 2
+	client := NewGatewayClient("test", config)
+
+	for range 2 {
+		err := client.PostJSON(context.Background(), server.URL, nil)
+		if err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("expected the gateway error, got %v", err)
+		}
+	}
+
+	err := client.PostJSON(context.Background(), server.URL, nil)
+	if !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen, got %v", err)
+	}
+	if !IsRetryable(err) {
+		t.Error("expected ErrCircuitOpen to be retryable")
+	}
+	if calls.Load() != 2 {
+		t.Errorf("expected the open breaker to skip the gateway, got %d calls", calls.Load())
+	}
+}
+
+func TestShouldPoison(t *testing.T) {
+	circuitOpen := &GatewayError{Gateway: "crm", Retryable: true, Err: ErrCircuitOpen}
+
+	if shouldPoison(fmt.Errorf("failed to send user to CRM: %w", circuitOpen)) {
+		t.Error("message failed on an open circuit breaker is poisoned")
+	}
+	if !shouldPoison(&GatewayError{Gateway: "crm", StatusCode: http.StatusServiceUnavailable, Retryable: true, Err: errors.New("unavailable")}) {
+		t.Error("message failed on a gateway error isn't poisoned")
+	}
+}
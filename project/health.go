@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const healthCheckTimeout = 2 * time.Second
+
+// HealthCheck is a single dependency checked by /readyz.
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type healthCheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	Status string                       `json:"status"`
+	Checks map[string]healthCheckResult `json:"checks"`
+}
+
+func dbHealthCheck(db *sqlx.DB) HealthCheck {
+	return HealthCheck{
+		Name:  "database",
+		Check: db.PingContext,
+	}
+}
+
+func pubSubHealthCheck(pubSub *PubSub) HealthCheck {
+	return HealthCheck{
+		Name:  "pubsub",
+		Check: pubSub.Ping,
+	}
+}
+
+func routerHealthCheck(router *message.Router) HealthCheck {
+	return HealthCheck{
+		Name: "router",
+		Check: func(ctx context.Context) error {
+			if router.IsClosed() {
+				return errors.New("router is closed")
+			}
+
+			select {
+			case <-router.Running():
+				return nil
+			default:
+				return errors.New("router is not running yet")
+			}
+		},
+	}
+}
+
+func forwarderHealthCheck(forwarderRunning func() bool) HealthCheck {
+	return HealthCheck{
+		Name: "forwarder",
+		Check: func(ctx context.Context) error {
+			if !forwarderRunning() {
+				return errors.New("forwarder is not running")
+			}
+			return nil
+		},
+	}
+}
+
+// runHealthChecks runs all checks concurrently, each with its own timeout.
+func runHealthChecks(ctx context.Context, checks []HealthCheck) (healthResponse, bool) {
+	resp := healthResponse{
+		Status: "ok",
+		Checks: make(map[string]healthCheckResult, len(checks)),
+	}
+	healthy := true
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+			defer cancel()
+
+			result := healthCheckResult{Status: "ok"}
+			if err := check.Check(ctx); err != nil {
+				result = healthCheckResult{Status: "failed", Error: err.Error()}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			resp.Checks[check.Name] = result
+			if result.Status != "ok" {
+				healthy = false
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if !healthy {
+		resp.Status = "failed"
+	}
+
+	return resp, healthy
+}
+
+// GetLivez reports whether the process is up. It doesn't check dependencies,
+// so an outage of Postgres or Kafka doesn't get the service restarted.
+func (h *HTTPHandlers) GetLivez(c echo.Context) error {
+	return c.JSON(http.StatusOK, healthResponse{
+		Status: "ok",
+		Checks: map[string]healthCheckResult{},
+	})
+}
+
+// GetReadyz reports whether the service can handle traffic.
+func (h *HTTPHandlers) GetReadyz(c echo.Context) error {
+	resp, healthy := runHealthChecks(c.Request().Context(), h.readinessChecks)
+	if !healthy {
+		return c.JSON(http.StatusServiceUnavailable, resp)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// closedAddr returns a local address nothing listens on, so connections are refused right away.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return addr
+}
+
+func TestGetReadyz(t *testing.T) {
+	unreachableDB, err := sqlx.Open("pgx", "postgres://user:password@"+closedAddr(t)+"/db?sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unreachableDB.Close() })
+
+	kafkaBrokers := []string{closedAddr(t)}
+	unreachableKafka := &PubSub{
+		backend: PubSubBackendKafka,
+		ping: func(ctx context.Context) error {
+			return pingKafka(kafkaBrokers)
+		},
+	}
+
+	okCheck := func(name string) HealthCheck {
+		return HealthCheck{Name: name, Check: func(ctx context.Context) error { return nil }}
+	}
+
+	testCases := []struct {
+		name         string
+		checks       []HealthCheck
+		wantStatus   int
+		wantFailures []string
+	}{
+		{
+			name:       "healthy",
+			checks:     []HealthCheck{okCheck("database"), okCheck("pubsub"), forwarderHealthCheck(func() bool { return true })},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:         "database_down",
+			checks:       []HealthCheck{dbHealthCheck(unreachableDB), okCheck("pubsub")},
+			wantStatus:   http.StatusServiceUnavailable,
+			wantFailures: []string{"database"},
+		},
+		{
+			name:         "kafka_down",
+			checks:       []HealthCheck{okCheck("database"), pubSubHealthCheck(unreachableKafka)},
+			wantStatus:   http.StatusServiceUnavailable,
+			wantFailures: []string{"pubsub"},
+		},
+		{
+			name: "forwarder_stopped",
+			checks: []HealthCheck{
+				okCheck("database"),
+				okCheck("pubsub"),
+				forwarderHealthCheck(func() bool { return false }),
+			},
+			wantStatus:   http.StatusServiceUnavailable,
+			wantFailures: []string{"forwarder"},
+		},
+		{
+			name:         "everything_down",
+			checks:       []HealthCheck{dbHealthCheck(unreachableDB), pubSubHealthCheck(unreachableKafka)},
+			wantStatus:   http.StatusServiceUnavailable,
+			wantFailures: []string{"database", "pubsub"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			router := NewHTTPRouter(DefaultConfig().HTTP, nil, nil, nil, nil, prometheus.NewRegistry(), nil, tc.checks, nil)
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("expected status %d, got %d: %s", tc.wantStatus, rec.Code, rec.Body)
+			}
+
+			var resp healthResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Checks) != len(tc.checks) {
+				t.Errorf("expected %d checks, got %v", len(tc.checks), resp.Checks)
+			}
+
+			wantResponseStatus := "ok"
+			if len(tc.wantFailures) > 0 {
+				wantResponseStatus = "failed"
+			}
+			if resp.Status != wantResponseStatus {
+				t.Errorf("expected status %q, got %q", wantResponseStatus, resp.Status)
+			}
+
+			for _, name := range tc.wantFailures {
+				if result := resp.Checks[name]; result.Status != "failed" || result.Error == "" {
+					t.Errorf("expected check %s to fail with an error, got %+v", name, result)
+				}
+			}
+		})
+	}
+}
+
+// The liveness check doesn't depend on anything, so it passes while dependencies are down.
+func TestGetLivez(t *testing.T) {
+	failing := HealthCheck{Name: "database", Check: func(ctx context.Context) error { return errors.New("down") }}
+	router := NewHTTPRouter(DefaultConfig().HTTP, nil, nil, nil, nil, prometheus.NewRegistry(), nil, []HealthCheck{failing}, nil)
+
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/livez", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+}
@@ -2,76 +2,164 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 	"unicode/utf8"
 
+	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/gofrs/uuid/v5"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 	echomiddleware "github.com/labstack/echo/v4/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func NewHTTPRouter(
+	config HTTPConfig,
 	db *sqlx.DB,
+	outbox *Outbox,
+	poisonQueue *PoisonQueue,
+	publisher message.Publisher,
+	metricsRegistry *prometheus.Registry,
+	outboxMonitor *OutboxMonitor,
+	readinessChecks []HealthCheck,
+	emailConfirmations *EmailConfirmations,
 ) *echo.Echo {
 	e := echo.New()
 	e.HideBanner = true
 	e.HTTPErrorHandler = echoErrorHandler
+	e.Server.ReadTimeout = config.ReadTimeout
+	e.Server.WriteTimeout = config.WriteTimeout
 
 	useEchoMiddleware(e)
 
 	h := HTTPHandlers{
-		db:       db,
+		db:          db,
+		outbox:      outbox,
+		poisonQueue: poisonQueue,
+		publisher:   publisher,
+
+		idempotencyKeyTTL: config.IdempotencyKeyTTL,
+		outboxMonitor:     outboxMonitor,
+		readinessChecks:   readinessChecks,
+
+		emailConfirmations: emailConfirmations,
 	}
 
-	e.GET("/health", func(c echo.Context) error {
-		return c.String(http.StatusOK, "ok")
-	})
+	e.GET("/metrics", echo.WrapHandler(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})))
+	e.GET("/health", h.GetHealth)
+	e.GET("/livez", h.GetLivez)
+	e.GET("/readyz", h.GetReadyz)
+	e.GET("/outbox/status", h.GetOutboxStatus)
 	e.POST("/users", h.PostUsers)
 	e.POST("/users/:id/email", h.PostUserEmail)
+	e.GET("/users/:id/email/confirm", h.GetUserEmailConfirm)
 	e.GET("/users/:id", h.GetUser)
 
+	// Poisoned messages carry user data and can be republished, so the admin API requires a token.
+	if config.AdminToken != "" {
+		admin := e.Group("/admin", adminAuthMiddleware(config.AdminToken))
+		admin.GET("/poisoned-messages", h.GetPoisonedMessages)
+		admin.POST("/poisoned-messages/:uuid/republish", h.PostRepublishPoisonedMessage)
+	} else {
+		slog.Info("Admin API is disabled, set ADMIN_TOKEN to enable it")
+	}
+
 	return e
 }
 
 type HTTPHandlers struct {
-	db       *sqlx.DB
+	db          *sqlx.DB
+	outbox      *Outbox
+	poisonQueue *PoisonQueue
+	publisher   message.Publisher
+
+	idempotencyKeyTTL time.Duration
+	outboxMonitor     *OutboxMonitor
+	readinessChecks   []HealthCheck
+
+	emailConfirmations *EmailConfirmations
+}
+
+func (h *HTTPHandlers) GetHealth(c echo.Context) error {
+	if h.outboxMonitor.Degraded() {
+		return c.String(http.StatusServiceUnavailable, "degraded")
+	}
+
+	return c.String(http.StatusOK, "ok")
+}
+
+func (h *HTTPHandlers) GetOutboxStatus(c echo.Context) error {
+	return c.JSON(http.StatusOK, h.outboxMonitor.Status())
 }
 
 func (h *HTTPHandlers) PostUsers(c echo.Context) error {
 	var req struct {
-		Name  string `json:"name"`
-		Email string `json:"email"`
+		Name   string `json:"name"`
+		Email  string `json:"email"`
+		Locale string `json:"locale"`
 	}
 	if err := c.Bind(&req); err != nil {
-		return fmt.Errorf("invalid request: %w", err)
+		return NewBadRequestError("invalid_request", "request body is not valid", err)
 	}
 
-	if req.Name == "" || req.Email == "" {
-		return errors.New("empty name or email")
+	var fieldErrors []FieldError
+	if req.Name == "" {
+		fieldErrors = append(fieldErrors, requiredFieldError("name"))
+	}
+	if req.Email == "" {
+		fieldErrors = append(fieldErrors, requiredFieldError("email"))
+	}
+	if len(fieldErrors) > 0 {
+		return NewValidationError(fieldErrors...)
+	}
+
+	email, err := NormalizeEmail(req.Email)
+	if err != nil {
+		return invalidEmailError("email")
+	}
+	req.Email = email
+
+	if req.Locale == "" {
+		req.Locale = DefaultLocale
+	} else if locale, ok := NormalizeLocale(req.Locale); ok {
+		req.Locale = locale
+	} else {
+		return NewValidationError(FieldError{
+			Field:   "locale",
+			Code:    "unsupported_locale",
+			Message: "must be one of: " + strings.Join(supportedLocales, ", "),
+		})
 	}
 
 	userID := uuid.Must(uuid.NewV7())
 	now := time.Now().UTC()
 
-	err := UpdateInTx(c.Request().Context(), h.db, sql.LevelRepeatableRead, func(ctx context.Context, tx *sqlx.Tx) error {
+	err = h.idempotentUpdateInTx(c, req, func(ctx context.Context, tx *sqlx.Tx) (int, any, error) {
 		_, err := tx.ExecContext(ctx, `
-			INSERT INTO users (id, name, email, registered_at)
-			VALUES ($1, $2, $3, $4)
-		`, userID, req.Name, req.Email, now)
+			INSERT INTO users (id, name, email, locale, registered_at)
+			VALUES ($1, $2, $3, $4, $5)
+		`, userID, req.Name, req.Email, req.Locale, now)
 		if err != nil {
-			return fmt.Errorf("failed to insert user: %w", err)
+			if isUniqueViolation(err, usersEmailKey) {
+				return 0, nil, emailTakenError("email")
+			}
+			return 0, nil, fmt.Errorf("failed to insert user: %w", err)
 		}
 
 		event := UserRegistered{
 			UserID:       userID,
 			Name:         req.Name,
 			Email:        req.Email,
+			Locale:       req.Locale,
 			RegisteredAt: now,
 		}
 
@@ -80,121 +168,260 @@ func (h *HTTPHandlers) PostUsers(c echo.Context) error {
 		// 	return fmt.Errorf("failed to publish event: %w", err)
 		// }
 
-		if err = PublishEventInTx(ctx, event, tx); err != nil {
-			return fmt.Errorf("failed to publish event: %w", err)
+		if err = h.outbox.PublishInTx(ctx, event, tx); err != nil {
+			return 0, nil, fmt.Errorf("failed to publish event: %w", err)
 		}
-		return nil
+
+		return http.StatusOK, map[string]any{
+			"user_id": userID,
+		}, nil
 	})
 	if err != nil {
 		return fmt.Errorf("failed to save user: %w", err)
 	}
 
-	return c.JSON(http.StatusOK, map[string]any{
-		"user_id": userID,
-	})
+	return nil
 }
 
 func (h *HTTPHandlers) PostUserEmail(c echo.Context) error {
 	userIDStr := c.Param("id")
 	userID, err := uuid.FromString(userIDStr)
 	if err != nil {
-		return fmt.Errorf("invalid user id: %w", err)
+		return NewBadRequestError("invalid_user_id", "user id must be a UUID", err)
 	}
 
 	var req struct {
 		NewEmail string `json:"new_email"`
 	}
 	if err := c.Bind(&req); err != nil {
-		return fmt.Errorf("invalid request: %w", err)
+		return NewBadRequestError("invalid_request", "request body is not valid", err)
 	}
 
 	if req.NewEmail == "" {
-		return errors.New("empty new_email")
+		return NewValidationError(requiredFieldError("new_email"))
+	}
+
+	newEmail, err := NormalizeEmail(req.NewEmail)
+	if err != nil {
+		return invalidEmailError("new_email")
 	}
+	req.NewEmail = newEmail
 
-	err = UpdateInTx(c.Request().Context(), h.db, sql.LevelRepeatableRead, func(ctx context.Context, tx *sqlx.Tx) error {
-		var oldEmail string
-		err := tx.GetContext(ctx, &oldEmail, `
-			SELECT email
+	changeID := uuid.Must(uuid.NewV7())
+	now := time.Now().UTC()
+	expiresAt := h.emailConfirmations.ExpiresAt(now)
+
+	err = h.idempotentUpdateInTx(c, req, func(ctx context.Context, tx *sqlx.Tx) (int, any, error) {
+		var user struct {
+			Email  string `db:"email"`
+			Locale string `db:"locale"`
+		}
+		// The row lock serializes email change requests of the user.
+		err := tx.GetContext(ctx, &user, `
+			SELECT email, locale
 			FROM users
 			WHERE id = $1
+			FOR UPDATE
 		`, userID)
 		if err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
-				return echo.ErrNotFound
+				return 0, nil, errUserNotFound
 			}
-			return fmt.Errorf("failed to get user email: %w", err)
+			return 0, nil, fmt.Errorf("failed to get user email: %w", err)
 		}
+		oldEmail := user.Email
 
-		slog.Info("Changing user email",
+		if strings.EqualFold(oldEmail, req.NewEmail) {
+			return 0, nil, NewUnprocessableError(
+				"email_unchanged",
+				"new email is the same as the current one",
+				FieldError{Field: "new_email", Code: "unchanged", Message: "must differ from the current email"},
+			)
+		}
+
+		var taken bool
+		err = tx.GetContext(ctx, &taken, `
+			SELECT EXISTS (SELECT 1 FROM users WHERE lower(email) = lower($1))
+		`, req.NewEmail)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to check if email is taken: %w", err)
+		}
+		if taken {
+			return 0, nil, emailTakenError("new_email")
+		}
+
+		slog.Info("Requesting user email change",
 			slog.String("user_id", userID.String()),
+			slog.String("change_id", changeID.String()),
 			slog.String("old_email", oldEmail),
 			slog.String("new_email", req.NewEmail),
 		)
 
-		res, err := tx.ExecContext(ctx, `
+		_, err = tx.ExecContext(ctx, `
+			UPDATE pending_email_changes
+			SET status = 'superseded', resolved_at = $2
+			WHERE user_id = $1 AND status = 'pending'
+		`, userID, now)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to supersede pending email changes: %w", err)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO pending_email_changes (id, user_id, old_email, new_email, requested_at, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6)
+		`, changeID, userID, oldEmail, req.NewEmail, now, expiresAt)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to insert pending email change: %w", err)
+		}
+
+		event := UserEmailChangeRequested{
+			UserID:      userID,
+			ChangeID:    changeID,
+			NewEmail:    req.NewEmail,
+			OldEmail:    oldEmail,
+			Locale:      user.Locale,
+			RequestedAt: now,
+			ExpiresAt:   expiresAt,
+		}
+
+		if err = h.outbox.PublishInTx(ctx, event, tx); err != nil {
+			return 0, nil, fmt.Errorf("failed to publish event: %w", err)
+		}
+
+		return http.StatusAccepted, map[string]any{
+			"change_id":  changeID,
+			"expires_at": expiresAt,
+		}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to request email change: %w", err)
+	}
+
+	return nil
+}
+
+// GetUserEmailConfirm applies an email change, from the link sent to the new address.
+func (h *HTTPHandlers) GetUserEmailConfirm(c echo.Context) error {
+	userID, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		return NewBadRequestError("invalid_user_id", "user id must be a UUID", err)
+	}
+
+	changeID, err := h.emailConfirmations.Verify(c.QueryParam("token"))
+	if err != nil {
+		if errors.Is(err, ErrExpiredConfirmationToken) {
+			return errEmailChangeExpired
+		}
+		return NewBadRequestError("invalid_token", "confirmation token is not valid", err)
+	}
+
+	err = h.idempotentUpdateInTx(c, changeID, func(ctx context.Context, tx *sqlx.Tx) (int, any, error) {
+		var change struct {
+			OldEmail string `db:"old_email"`
+			NewEmail string `db:"new_email"`
+			Status   string `db:"status"`
+			Locale   string `db:"locale"`
+		}
+		err := tx.GetContext(ctx, &change, `
+			SELECT c.old_email, c.new_email, c.status, u.locale
+			FROM pending_email_changes c
+			JOIN users u ON u.id = c.user_id
+			WHERE c.id = $1 AND c.user_id = $2
+			FOR UPDATE OF c
+		`, changeID, userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return 0, nil, NewNotFoundError("email_change_not_found", "email change not found")
+			}
+			return 0, nil, fmt.Errorf("failed to get pending email change: %w", err)
+		}
+
+		switch change.Status {
+		case "pending":
+		case "confirmed":
+			// The link was opened again.
+			return http.StatusOK, map[string]any{"email": change.NewEmail}, nil
+		case "superseded":
+			return 0, nil, NewConflictError("email_change_superseded", "a newer email change was requested")
+		default:
+			return 0, nil, errEmailChangeExpired
+		}
+
+		now := time.Now().UTC()
+
+		_, err = tx.ExecContext(ctx, `
 			UPDATE users
 			SET email = $1
 			WHERE id = $2
-		`, req.NewEmail, userID)
+		`, change.NewEmail, userID)
 		if err != nil {
-			return fmt.Errorf("failed to update user email: %w", err)
+			if isUniqueViolation(err, usersEmailKey) {
+				return 0, nil, emailTakenError("new_email")
+			}
+			return 0, nil, fmt.Errorf("failed to update user email: %w", err)
 		}
 
-		rowsAffected, err := res.RowsAffected()
+		_, err = tx.ExecContext(ctx, `
+			UPDATE pending_email_changes
+			SET status = 'confirmed', resolved_at = $2
+			WHERE id = $1
+		`, changeID, now)
 		if err != nil {
-			return fmt.Errorf("failed to get rows affected: %w", err)
-		}
-		if rowsAffected == 0 {
-			return echo.ErrNotFound
+			return 0, nil, fmt.Errorf("failed to confirm email change: %w", err)
 		}
 
-		event := UserEmailUpdated {
-			UserID: userID,
-			NewEmail: req.NewEmail,
-			OldEmail: oldEmail,
-			UpdatedAt: time.Now(),
-		}
+		slog.Info("Changing user email",
+			slog.String("user_id", userID.String()),
+			slog.String("change_id", changeID.String()),
+			slog.String("old_email", change.OldEmail),
+			slog.String("new_email", change.NewEmail),
+		)
 
-		// if err := h.eventBus.Publish(ctx, event); err != nil {
-		// 	return fmt.Errorf("failed to publish event: %w", err)
-		// }
+		event := UserEmailConfirmed{
+			UserID:      userID,
+			ChangeID:    changeID,
+			NewEmail:    change.NewEmail,
+			OldEmail:    change.OldEmail,
+			Locale:      change.Locale,
+			ConfirmedAt: now,
+		}
 
-		if err = PublishEventInTx(ctx, event, tx); err != nil {
-			return fmt.Errorf("failed to publish event: %w", err)
+		if err = h.outbox.PublishInTx(ctx, event, tx); err != nil {
+			return 0, nil, fmt.Errorf("failed to publish event: %w", err)
 		}
 
-		return nil
+		return http.StatusOK, map[string]any{"email": change.NewEmail}, nil
 	})
 	if err != nil {
-		return fmt.Errorf("failed to update user: %w", err)
+		return fmt.Errorf("failed to confirm email change: %w", err)
 	}
 
-	return c.NoContent(http.StatusOK)
+	return nil
 }
 
 func (h *HTTPHandlers) GetUser(c echo.Context) error {
 	userIDStr := c.Param("id")
 	userID, err := uuid.FromString(userIDStr)
 	if err != nil {
-		return fmt.Errorf("invalid user id: %w", err)
+		return NewBadRequestError("invalid_user_id", "user id must be a UUID", err)
 	}
 
 	var user struct {
 		ID           uuid.UUID `db:"id" json:"id"`
 		Name         string    `db:"name" json:"name"`
 		Email        string    `db:"email" json:"email"`
+		Locale       string    `db:"locale" json:"locale"`
 		RegisteredAt time.Time `db:"registered_at" json:"registered_at"`
 	}
 
 	err = h.db.GetContext(c.Request().Context(), &user, `
-			SELECT id, name, email, registered_at
+			SELECT id, name, email, locale, registered_at
 			FROM users
 			WHERE id = $1
 		`, userID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.ErrNotFound
+			return errUserNotFound
 		}
 		return fmt.Errorf("failed to get user: %w", err)
 	}
@@ -202,31 +429,143 @@ func (h *HTTPHandlers) GetUser(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
-func echoErrorHandler(err error, c echo.Context) {
-	slog.With("error", err).Error("HTTP error")
+func (h *HTTPHandlers) GetPoisonedMessages(c echo.Context) error {
+	messages, err := h.poisonQueue.List(c.Request().Context())
+	if err != nil {
+		return err
+	}
 
-	httpCode := http.StatusInternalServerError
-	msg := any("Internal server error")
+	return c.JSON(http.StatusOK, messages)
+}
 
-	httpErr := &echo.HTTPError{}
-	if errors.As(err, &httpErr) {
-		httpCode = httpErr.Code
-		msg = httpErr.Message
+func (h *HTTPHandlers) PostRepublishPoisonedMessage(c echo.Context) error {
+	err := h.poisonQueue.Republish(c.Request().Context(), c.Param("uuid"), h.publisher)
+	if err != nil {
+		if errors.Is(err, ErrPoisonedMessageNotFound) {
+			return NewNotFoundError("poisoned_message_not_found", "poisoned message not found")
+		}
+		return fmt.Errorf("failed to republish poisoned message: %w", err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+const minAdminTokenLength = 16
+
+var errAdminUnauthorized = NewUnauthorizedError("unauthorized", "a valid admin token is required")
+
+// adminAuthMiddleware accepts requests with the admin token in the "Authorization: Bearer" header.
+func adminAuthMiddleware(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			given, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer realm="admin"`)
+				return errAdminUnauthorized
+			}
+
+			return next(c)
+		}
 	}
+}
+
+// usersEmailKey is the unique index on lower(users.email).
+const usersEmailKey = "users_email_key"
+
+var errUserNotFound = NewNotFoundError("user_not_found", "user not found")
+
+var errEmailChangeExpired = NewConflictError("email_change_expired", "email change has expired, request it again")
+
+func requiredFieldError(field string) FieldError {
+	return FieldError{Field: field, Code: "required", Message: "must not be empty"}
+}
+
+func invalidEmailError(field string) error {
+	return NewValidationError(FieldError{
+		Field:   field,
+		Code:    "invalid_email",
+		Message: "must be a valid email address",
+	})
+}
 
-	jsonErr := c.JSON(
-		httpCode,
-		map[string]any{
-			"error": msg,
-		},
+func emailTakenError(field string) error {
+	return NewConflictError(
+		"email_taken",
+		"email address is already registered",
+		FieldError{Field: field, Code: "taken", Message: "is already registered"},
 	)
+}
+
+func echoErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	appErr := &AppError{}
+	httpErr := &echo.HTTPError{}
+
+	switch {
+	case errors.As(err, &appErr):
+		if appErr.Status >= http.StatusInternalServerError {
+			slog.With("error", err).Error("HTTP error")
+		} else {
+			slog.With("error", err).Info("HTTP client error")
+		}
+	case errors.As(err, &httpErr):
+		slog.With("error", err).Info("HTTP client error")
+
+		appErr = &AppError{
+			Status:  httpErr.Code,
+			Code:    statusCode(httpErr.Code),
+			Message: fmt.Sprint(httpErr.Message),
+		}
+	default:
+		slog.With("error", err).Error("HTTP error")
+
+		appErr = &AppError{
+			Status:  http.StatusInternalServerError,
+			Code:    "internal_error",
+			Message: "Internal server error",
+		}
+	}
+
+	body, jsonErr := json.Marshal(newProblem(appErr))
 	if jsonErr != nil {
-		panic(err)
+		panic(jsonErr)
+	}
+
+	if blobErr := c.Blob(appErr.Status, problemContentType, body); blobErr != nil {
+		slog.With("error", blobErr).Error("Failed to write HTTP error response")
+	}
+}
+
+// responseStatus returns the status of the response to a request that returned err.
+// Middlewares return the error and leave writing the response to the error handler,
+// so the status is taken from the error the same way echoErrorHandler does.
+func responseStatus(c echo.Context, err error) int {
+	if err == nil || c.Response().Committed {
+		return c.Response().Status
+	}
+
+	appErr := &AppError{}
+	httpErr := &echo.HTTPError{}
+
+	switch {
+	case errors.As(err, &appErr):
+		return appErr.Status
+	case errors.As(err, &httpErr):
+		return httpErr.Code
+	default:
+		return http.StatusInternalServerError
 	}
 }
 
 func useEchoMiddleware(e *echo.Echo) {
 	e.Use(
+		echomiddleware.RequestID(),
+		echoCorrelationIDMiddleware,
+		echoTracingMiddleware,
+		echoMetricsMiddleware,
 		echomiddleware.BodyDump(func(c echo.Context, reqBody, resBody []byte) {
 			reqID := c.Response().Header().Get(echo.HeaderXRequestID)
 
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+const DefaultIdempotencyKeyTTL = 24 * time.Hour
+
+type storedResponse struct {
+	RequestHash string `db:"request_hash"`
+	Status      int    `db:"response_status"`
+	Body        []byte `db:"response_body"`
+}
+
+// idempotentUpdateInTx runs fn in a transaction and responds with its result.
+//
+// When the request has an Idempotency-Key header, the key is claimed and the response is stored
+// in the same transaction, and later requests with that key get the stored response replayed
+// without running fn again. Concurrent requests with the same key wait for the first one.
+// A nil body is sent as an empty response.
+func (h *HTTPHandlers) idempotentUpdateInTx(
+	c echo.Context,
+	request any,
+	fn func(ctx context.Context, tx *sqlx.Tx) (status int, body any, err error),
+) error {
+	key := c.Request().Header.Get(HeaderIdempotencyKey)
+	ctx := c.Request().Context()
+
+	if key == "" {
+		var resp storedResponse
+		err := h.outbox.UpdateInTx(ctx, h.db, sql.LevelRepeatableRead, func(ctx context.Context, tx *sqlx.Tx) error {
+			var err error
+			resp, err = runForResponse(ctx, tx, fn)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		return sendStoredResponse(c, resp)
+	}
+
+	requestHash, err := hashRequest(c, request)
+	if err != nil {
+		return err
+	}
+
+	var resp storedResponse
+	err = h.outbox.UpdateInTx(ctx, h.db, sql.LevelRepeatableRead, func(ctx context.Context, tx *sqlx.Tx) error {
+		stored, claimed, err := h.claimKey(ctx, tx, key, requestHash)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			resp = stored
+			return nil
+		}
+
+		resp, err = runForResponse(ctx, tx, fn)
+		if err != nil {
+			return err
+		}
+		resp.RequestHash = requestHash
+
+		return h.storeResponse(ctx, tx, key, resp)
+	})
+	if err != nil {
+		return err
+	}
+
+	if resp.RequestHash != requestHash {
+		return NewUnprocessableError(
+			"idempotency_key_reused",
+			"Idempotency-Key was already used with a different request",
+		)
+	}
+
+	return sendStoredResponse(c, resp)
+}
+
+func runForResponse(
+	ctx context.Context,
+	tx *sqlx.Tx,
+	fn func(ctx context.Context, tx *sqlx.Tx) (int, any, error),
+) (storedResponse, error) {
+	status, body, err := fn(ctx, tx)
+	if err != nil {
+		return storedResponse{}, err
+	}
+
+	resp := storedResponse{Status: status}
+	if body != nil {
+		resp.Body, err = json.Marshal(body)
+		if err != nil {
+			return storedResponse{}, fmt.Errorf("failed to marshal response: %w", err)
+		}
+	}
+
+	return resp, nil
+}
+
+// claimKey inserts the key before fn runs, so a concurrent request with the same key waits
+// for this transaction to end. The row holds no response until storeResponse, but it's only
+// visible to others after the commit.
+//
+// When the competitor commits first, the insert fails to serialize and UpdateInTx retries it,
+// then the key isn't claimed and the stored response is returned. An expired key is claimed again.
+func (h *HTTPHandlers) claimKey(
+	ctx context.Context,
+	tx *sqlx.Tx,
+	key string,
+	requestHash string,
+) (stored storedResponse, claimed bool, err error) {
+	now := time.Now().UTC()
+
+	res, err := tx.ExecContext(ctx, `
+		INSERT INTO idempotency_keys (key, request_hash, response_status, response_body, created_at, expires_at)
+		VALUES ($1, $2, 0, NULL, $3, $4)
+		ON CONFLICT (key) DO UPDATE SET
+			request_hash = excluded.request_hash,
+			response_status = excluded.response_status,
+			response_body = excluded.response_body,
+			created_at = excluded.created_at,
+			expires_at = excluded.expires_at
+		WHERE idempotency_keys.expires_at <= $3
+	`, key, requestHash, now, now.Add(h.idempotencyKeyTTL))
+	if err != nil {
+		return storedResponse{}, false, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return storedResponse{}, false, fmt.Errorf("failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 1 {
+		return storedResponse{}, true, nil
+	}
+
+	err = tx.GetContext(ctx, &stored, `
+		SELECT request_hash, response_status, response_body
+		FROM idempotency_keys
+		WHERE key = $1
+	`, key)
+	if err != nil {
+		return storedResponse{}, false, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+
+	return stored, false, nil
+}
+
+func (h *HTTPHandlers) storeResponse(ctx context.Context, tx *sqlx.Tx, key string, resp storedResponse) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE idempotency_keys
+		SET response_status = $2, response_body = $3
+		WHERE key = $1
+	`, key, resp.Status, resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to store idempotency key: %w", err)
+	}
+
+	return nil
+}
+
+func hashRequest(c echo.Context, request any) (string, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(c.Request().Method + " " + c.Request().URL.Path + "\n"))
+	hash.Write(body)
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func sendStoredResponse(c echo.Context, resp storedResponse) error {
+	if resp.Body == nil {
+		return c.NoContent(resp.Status)
+	}
+	return c.JSONBlob(resp.Status, resp.Body)
+}
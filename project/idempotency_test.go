@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+type idempotentResponse struct {
+	Status int
+	Body   string
+}
+
+// idempotentRequest sends body as JSON with the Idempotency-Key header.
+func (s *testService) idempotentRequest(t *testing.T, path string, key string, body any) idempotentResponse {
+	t.Helper()
+
+	reqBody, err := json.Marshal(body)
+	if err != nil {
+		t.Error(err)
+		return idempotentResponse{}
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url(path), bytes.NewReader(reqBody))
+	if err != nil {
+		t.Error(err)
+		return idempotentResponse{}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderIdempotencyKey, key)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Errorf("POST %s failed: %v", path, err)
+		return idempotentResponse{}
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Error(err)
+	}
+
+	return idempotentResponse{Status: resp.StatusCode, Body: string(respBody)}
+}
+
+func (s *testService) countUsers(t *testing.T, email string) int {
+	t.Helper()
+
+	var count int
+	if err := s.db.Get(&count, `SELECT count(*) FROM users WHERE email = $1`, email); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func TestIdempotencyKey_replay(t *testing.T) {
+	s := newTestService(t)
+
+	key := "key-" + randomHex(t, 8)
+	email := "user-" + randomHex(t, 4) + "@example.com"
+	body := map[string]string{"name": "Test User", "email": email}
+
+	first := s.idempotentRequest(t, "/users", key, body)
+	if first.Status != http.StatusOK {
+		t.Fatalf("POST /users returned %d: %s", first.Status, first.Body)
+	}
+
+	second := s.idempotentRequest(t, "/users", key, body)
+	if second != first {
+		t.Errorf("expected the response to be replayed\nfirst: %+v\nsecond: %+v", first, second)
+	}
+	if n := s.countUsers(t, email); n != 1 {
+		t.Errorf("expected 1 user, got %d", n)
+	}
+}
+
+func TestIdempotencyKey_differentRequest(t *testing.T) {
+	s := newTestService(t)
+
+	key := "key-" + randomHex(t, 8)
+	email := "user-" + randomHex(t, 4) + "@example.com"
+
+	first := s.idempotentRequest(t, "/users", key, map[string]string{"name": "Test User", "email": email})
+	if first.Status != http.StatusOK {
+		t.Fatalf("POST /users returned %d: %s", first.Status, first.Body)
+	}
+
+	otherEmail := "other-" + randomHex(t, 4) + "@example.com"
+	second := s.idempotentRequest(t, "/users", key, map[string]string{"name": "Test User", "email": otherEmail})
+	if second.Status != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusUnprocessableEntity, second.Status, second.Body)
+	}
+
+	var problem Problem
+	if err := json.Unmarshal([]byte(second.Body), &problem); err != nil {
+		t.Fatal(err)
+	}
+	if problem.Code != "idempotency_key_reused" {
+		t.Errorf("expected code idempotency_key_reused, got %q", problem.Code)
+	}
+	if n := s.countUsers(t, otherEmail); n != 0 {
+		t.Errorf("expected the second request not to run, got %d users", n)
+	}
+}
+
+func TestIdempotencyKey_expired(t *testing.T) {
+	s := newTestService(t)
+
+	key := "key-" + randomHex(t, 8)
+	email := "user-" + randomHex(t, 4) + "@example.com"
+	body := map[string]string{"name": "Test User", "email": email}
+
+	first := s.idempotentRequest(t, "/users", key, body)
+	if first.Status != http.StatusOK {
+		t.Fatalf("POST /users returned %d: %s", first.Status, first.Body)
+	}
+
+	if _, err := s.db.Exec(`UPDATE idempotency_keys SET expires_at = now() - interval '1 second' WHERE key = $1`, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// The request runs again, and the user already exists.
+	second := s.idempotentRequest(t, "/users", key, body)
+	if second.Status != http.StatusConflict {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusConflict, second.Status, second.Body)
+	}
+
+	otherEmail := "other-" + randomHex(t, 4) + "@example.com"
+	third := s.idempotentRequest(t, "/users", key, map[string]string{"name": "Test User", "email": otherEmail})
+	if third.Status != http.StatusUnprocessableEntity {
+		t.Errorf("expected the new response to be stored, got %d: %s", third.Status, third.Body)
+	}
+}
+
+func TestIdempotencyKey_concurrent(t *testing.T) {
+	s := newTestService(t)
+
+	const requests = 5
+
+	sendConcurrently := func(path string, key string, body any) []idempotentResponse {
+		responses := make([]idempotentResponse, requests)
+
+		var wg sync.WaitGroup
+		for i := range requests {
+			wg.Go(func() {
+				responses[i] = s.idempotentRequest(t, path, key, body)
+			})
+		}
+		wg.Wait()
+
+		for _, resp := range responses[1:] {
+			if resp != responses[0] {
+				t.Errorf("expected all requests to get the same response\nfirst: %+v\nother: %+v", responses[0], resp)
+			}
+		}
+		return responses
+	}
+
+	t.Run("register_user", func(t *testing.T) {
+		email := "user-" + randomHex(t, 4) + "@example.com"
+
+		responses := sendConcurrently("/users", "key-"+randomHex(t, 8), map[string]string{"name": "Test User", "email": email})
+		if responses[0].Status != http.StatusOK {
+			t.Errorf("expected status %d, got %d: %s", http.StatusOK, responses[0].Status, responses[0].Body)
+		}
+		if n := s.countUsers(t, email); n != 1 {
+			t.Errorf("expected 1 user, got %d", n)
+		}
+	})
+
+	t.Run("change_email", func(t *testing.T) {
+		userID := s.registerUser(t, "Test User", "old-"+randomHex(t, 4)+"@example.com")
+		newEmail := "new-" + randomHex(t, 4) + "@example.com"
+
+		path := fmt.Sprintf("/users/%s/email", userID)
+		responses := sendConcurrently(path, "key-"+randomHex(t, 8), map[string]string{"new_email": newEmail})
+		if responses[0].Status != http.StatusAccepted {
+			t.Errorf("expected status %d, got %d: %s", http.StatusAccepted, responses[0].Status, responses[0].Body)
+		}
+
+		waitForExactlyOnce(t, "confirmation email", func() int {
+			return len(s.gateway.Emails(newEmail, "Confirm your new email address"))
+		})
+
+		var changes int
+		if err := s.db.Get(&changes, `SELECT count(*) FROM pending_email_changes WHERE user_id = $1`, userID); err != nil {
+			t.Fatal(err)
+		}
+		if changes != 1 {
+			t.Errorf("expected 1 email change, got %d", changes)
+		}
+	})
+}
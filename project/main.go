@@ -2,91 +2,125 @@ package main
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/jmoiron/sqlx"
 	"github.com/lmittmann/tint"
-	"golang.org/x/sync/errgroup"
+	"go.opentelemetry.io/otel"
 )
 
 func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	db, err := sqlx.Open("pgx", os.Getenv("POSTGRES_URL"))
-	if err != nil {
-		panic(err)
+	// The migrate command only needs the database, so it runs before the rest of the service is configured.
+	migrate := len(os.Args) > 1 && os.Args[1] == "migrate"
+
+	loadConfig := LoadConfig
+	if migrate {
+		loadConfig = LoadMigrateConfig
 	}
-	defer db.Close()
 
-	err = MigrateDB(ctx, db)
+	config, err := loadConfig()
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	slog.SetDefault(slog.New(
-		tint.NewHandler(os.Stderr, &tint.Options{
-			Level:      slog.LevelDebug,
+	slog.SetDefault(slog.New(correlationIDLogHandler{
+		Handler: tint.NewHandler(os.Stderr, &tint.Options{
+			Level:      config.LogLevel,
 			TimeFormat: "15:04:05.000",
 		}),
-	))
+	}))
 
-	crmClient := CRMClient{
-		ApiEndpoint: os.Getenv("GATEWAY_ADDR") + "/crm-api/crm/users",
+	tracerProvider, err := NewTracerProvider(ctx)
+	if err != nil {
+		panic(err)
 	}
+	defer tracerProvider.Shutdown(context.Background())
 
-	emailSender := EmailSender{
-		ApiEndpoint: os.Getenv("GATEWAY_ADDR") + "/emails-api/email/send",
-	}
+	otel.SetTracerProvider(tracerProvider)
 
-	watermillRouter, err := NewWatermillRouter()
+	db, err := sqlx.Open("pgx", config.PostgresURL)
 	if err != nil {
 		panic(err)
 	}
+	defer db.Close()
+
+	if migrate {
+		if err := runMigrateCommand(ctx, db, os.Args[2:]); err != nil {
+			panic(err)
+		}
+		return
+	}
 
-	err = NewWatermillHandlers(watermillRouter, emailSender, crmClient)
+	err = MigrateDB(ctx, db)
 	if err != nil {
 		panic(err)
 	}
 
-	echoRouter := NewHTTPRouter(db)
-
-	slog.Info("Starting service")
+	crmClient := NewCRMClient(config.Gateway.Addr, config.Gateway.CRM)
 
-	errgrp, ctx := errgroup.WithContext(ctx)
+	emailProvider, err := NewEmailProvider(config.Email, config.Gateway)
+	if err != nil {
+		panic(err)
+	}
 
-	errgrp.Go(func() error {
-		return watermillRouter.Run(ctx)
-	})
+	emailTemplates, err := NewEmailTemplates()
+	if err != nil {
+		panic(err)
+	}
 
-	errgrp.Go(func() error {
-		// Wait for the Watermill router to be running before starting the HTTP server, so the service isn't marked as healthy before
-		<-watermillRouter.Running()
+	mailer := NewMailer(emailProvider, emailTemplates)
 
-		err := echoRouter.Start(":8080")
+	pubSub, err := NewPubSub(config.PubSub, db, newWatermillLogger())
+	if err != nil {
+		panic(err)
+	}
 
-		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			return err
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		crmBatcher := NewCRMBatcher(db, crmClient, config.Gateway.CRMBatch)
+		handlers := (&WatermillHandlers{
+			mailer:             mailer,
+			emailConfirmations: NewEmailConfirmations(config.EmailConfirmation),
+			crm:                crmBatcher,
+		}).EventHandlers()
+		if err := runReplayCommand(ctx, pubSub, handlers, crmBatcher, os.Args[2:]); err != nil {
+			panic(err)
 		}
+		return
+	}
 
-		return nil
-	})
+	outbox, err := NewOutbox(newWatermillLogger())
+	if err != nil {
+		panic(err)
+	}
 
-	errgrp.Go(func() error {
-		<-ctx.Done()
-		return echoRouter.Shutdown(context.Background())
-	})
+	metricsRegistry, err := NewMetricsRegistry(db)
+	if err != nil {
+		panic(err)
+	}
 
-	errgrp.Go(func() error {
-		return RunForwarder(ctx, db)
-	})
+	service, err := NewService(
+		config,
+		db,
+		pubSub,
+		outbox,
+		mailer,
+		crmClient,
+		metricsRegistry,
+	)
+	if err != nil {
+		panic(err)
+	}
 
-	if err := errgrp.Wait(); err != nil {
+	if err := service.Run(ctx, config.HTTP.Addr()); err != nil {
 		panic(err)
 	}
 }
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/metrics"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const metricsNamespace = "project"
+
+var (
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of HTTP requests in seconds.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"method", "route", "status"},
+	)
+
+	gatewayRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: "gateway",
+			Name:      "requests_total",
+			Help:      "Calls to the email and CRM gateways, by outcome.",
+		},
+		[]string{"gateway", "outcome"},
+	)
+)
+
+// NewMetricsRegistry creates the registry exposed on /metrics, with the HTTP, gateway, outbox and CRM queue metrics.
+// Router metrics are added to it by NewWatermillRouter.
+func NewMetricsRegistry(db *sqlx.DB) (*prometheus.Registry, error) {
+	registry := prometheus.NewRegistry()
+
+	for _, c := range []prometheus.Collector{
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestDuration,
+		gatewayRequestsTotal,
+		outboxCleanedRowsTotal,
+		processedMessagesCleanedRowsTotal,
+		newOutboxCollector(db),
+		newCRMQueueCollector(db),
+	} {
+		if err := registry.Register(c); err != nil {
+			return nil, fmt.Errorf("failed to register metrics collector: %w", err)
+		}
+	}
+
+	return registry, nil
+}
+
+// addRouterMetrics adds handler execution time histograms, labelled by handler_name and success,
+// and publish/subscribe metrics to the router.
+func addRouterMetrics(router *message.Router, registry prometheus.Registerer) {
+	metrics.NewPrometheusMetricsBuilder(registry, metricsNamespace, "watermill").AddPrometheusRouterMetrics(router)
+}
+
+func echoMetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+
+		err := next(c)
+
+		httpRequestDuration.WithLabelValues(
+			c.Request().Method,
+			c.Path(),
+			strconv.Itoa(responseStatus(c, err)),
+		).Observe(time.Since(start).Seconds())
+
+		return err
+	}
+}
+
+func observeGatewayCall(gateway string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	gatewayRequestsTotal.WithLabelValues(gateway, outcome).Inc()
+}
+
+// outboxCollector reads the outbox table on each scrape.
+type outboxCollector struct {
+	db *sqlx.DB
+
+	messages                *prometheus.Desc
+	pendingMessages         *prometheus.Desc
+	oldestPendingAgeSeconds *prometheus.Desc
+}
+
+func newOutboxCollector(db *sqlx.DB) *outboxCollector {
+	return &outboxCollector{
+		db: db,
+		messages: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "outbox", "messages"),
+			"Rows in the outbox table.",
+			nil, nil,
+		),
+		pendingMessages: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "outbox", "pending_messages"),
+			"Outbox rows not forwarded yet.",
+			nil, nil,
+		),
+		oldestPendingAgeSeconds: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "outbox", "oldest_pending_age_seconds"),
+			"Age of the oldest outbox row not forwarded yet, 0 if there are none.",
+			nil, nil,
+		),
+	}
+}
+
+func (c *outboxCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.messages
+	ch <- c.pendingMessages
+	ch <- c.oldestPendingAgeSeconds
+}
+
+func (c *outboxCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stats, err := GetOutboxStats(ctx, c.db)
+	if err != nil {
+		slog.With("error", err).Error("Failed to collect outbox metrics")
+		ch <- prometheus.NewInvalidMetric(c.messages, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.messages, prometheus.GaugeValue, float64(stats.Messages))
+	ch <- prometheus.MustNewConstMetric(c.pendingMessages, prometheus.GaugeValue, float64(stats.PendingMessages))
+	ch <- prometheus.MustNewConstMetric(c.oldestPendingAgeSeconds, prometheus.GaugeValue, stats.OldestPendingAge.Seconds())
+}
+
+// crmQueueCollector reads the CRM queue table on each scrape.
+type crmQueueCollector struct {
+	db *sqlx.DB
+
+	users       *prometheus.Desc
+	failedUsers *prometheus.Desc
+}
+
+func newCRMQueueCollector(db *sqlx.DB) *crmQueueCollector {
+	return &crmQueueCollector{
+		db: db,
+		users: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "crm_queue", "users"),
+			"Users queued to be sent to the CRM, including the ones waiting for a retry.",
+			nil, nil,
+		),
+		failedUsers: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "crm_queue", "failed_users"),
+			"Users that couldn't be sent to the CRM and won't be retried until they're queued again.",
+			nil, nil,
+		),
+	}
+}
+
+func (c *crmQueueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.users
+	ch <- c.failedUsers
+}
+
+func (c *crmQueueCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stats, err := GetCRMQueueStats(ctx, c.db)
+	if err != nil {
+		slog.With("error", err).Error("Failed to collect CRM queue metrics")
+		ch <- prometheus.NewInvalidMetric(c.users, err)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.users, prometheus.GaugeValue, float64(stats.Queued))
+	ch <- prometheus.MustNewConstMetric(c.failedUsers, prometheus.GaugeValue, float64(stats.Failed))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	s := newTestService(t)
+
+	email := "user-" + randomHex(t, 4) + "@example.com"
+	userID := s.registerUser(t, "Test User", email)
+
+	// Handler and gateway metrics only show up once something was handled.
+	waitFor(t, 10*time.Second, "user to be handled", func() bool {
+		return len(s.gateway.Emails(email, "Welcome to our website!")) > 0 && len(s.gateway.CRMUsers(userID)) > 0
+	})
+
+	families, err := s.metricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+
+	for _, name := range []string{
+		"project_http_request_duration_seconds",
+		"project_gateway_requests_total",
+		"project_outbox_messages",
+		"project_outbox_pending_messages",
+		"project_outbox_oldest_pending_age_seconds",
+		"project_crm_queue_users",
+		"project_crm_queue_failed_users",
+		"project_outbox_cleaned_rows_total",
+		"project_processed_messages_cleaned_rows_total",
+		"project_watermill_handler_execution_time_seconds",
+		"project_watermill_subscriber_messages_received_total",
+		"go_goroutines",
+	} {
+		if !names[name] {
+			t.Errorf("metric %s is not registered", name)
+		}
+	}
+}
+
+// httpRequestCount returns the number of requests observed by echoMetricsMiddleware with the labels.
+func httpRequestCount(t *testing.T, registry *prometheus.Registry, method string, route string, status int) uint64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"method": method, "route": route, "status": strconv.Itoa(status)}
+
+	for _, family := range families {
+		if family.GetName() != "project_http_request_duration_seconds" {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if want[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetHistogram().GetSampleCount()
+		}
+	}
+
+	return 0
+}
+
+func TestEchoMetricsMiddleware_status(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(httpRequestDuration)
+
+	testCases := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{name: "ok", wantStatus: http.StatusOK},
+		{name: "app_error", err: NewUnprocessableError("email_unchanged", "new email is the same as the current one"), wantStatus: http.StatusUnprocessableEntity},
+		{name: "echo_error", err: echo.ErrForbidden, wantStatus: http.StatusForbidden},
+		{name: "unknown_error", err: errors.New("connection refused"), wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := "/metrics-test/" + tc.name
+
+			var errorHandlerCalls int
+			e := echo.New()
+			e.HTTPErrorHandler = func(err error, c echo.Context) {
+				errorHandlerCalls++
+				echoErrorHandler(err, c)
+			}
+			e.Use(echoTracingMiddleware, echoMetricsMiddleware)
+			e.POST(path, func(c echo.Context) error {
+				if tc.err != nil {
+					return tc.err
+				}
+				return c.NoContent(http.StatusOK)
+			})
+
+			before := httpRequestCount(t, registry, http.MethodPost, path, tc.wantStatus)
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("expected status %d, got %d", tc.wantStatus, rec.Code)
+			}
+			if tc.err != nil && errorHandlerCalls != 1 {
+				t.Errorf("expected the error handler to be called once, got %d calls", errorHandlerCalls)
+			}
+			if n := httpRequestCount(t, registry, http.MethodPost, path, tc.wantStatus) - before; n != 1 {
+				t.Errorf("expected 1 request observed with status %d, got %d", tc.wantStatus, n)
+			}
+		})
+	}
+}
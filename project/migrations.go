@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationsLockID is the Postgres advisory lock held while migrations run,
+// so replicas starting at the same time don't apply the same migration twice.
+const migrationsLockID = 7_391_004
+
+type migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// loadMigrations reads migrations/<version>_<name>.<up|down>.sql files, ordered by version.
+func loadMigrations() ([]migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("could not list migrations: %w", err)
+	}
+
+	byVersion := map[int]*migration{}
+	for _, file := range files {
+		base := path.Base(file)
+
+		name, direction, ok := strings.Cut(strings.TrimSuffix(base, ".sql"), ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name: %s", base)
+		}
+
+		versionStr, name, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("invalid migration file name: %s", base)
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid migration version in %s: %w", base, err)
+		}
+
+		content, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read migration %s: %w", base, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration %d has conflicting names: %s and %s", version, m.Name, name)
+		}
+
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d_%s has no up file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// MigrateDB applies all pending migrations.
+func MigrateDB(ctx context.Context, db *sqlx.DB) error {
+	return MigrateUp(ctx, db, 0)
+}
+
+// MigrateUp applies up to steps pending migrations, or all of them if steps is 0.
+func MigrateUp(ctx context.Context, db *sqlx.DB, steps int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, db, func(conn *sqlx.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		count := 0
+		for _, m := range migrations {
+			if steps > 0 && count >= steps {
+				break
+			}
+			if applied[m.Version] {
+				continue
+			}
+
+			slog.Info("Applying migration", "version", m.Version, "name", m.Name)
+
+			err := runMigration(ctx, conn, m.Up, func(tx *sqlx.Tx) error {
+				_, err := tx.ExecContext(ctx, `
+					INSERT INTO schema_migrations (version, name)
+					VALUES ($1, $2)
+				`, m.Version, m.Name)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("could not apply migration %d_%s: %w", m.Version, m.Name, err)
+			}
+
+			count++
+		}
+
+		return nil
+	})
+}
+
+// MigrateDown reverts the last steps applied migrations.
+func MigrateDown(ctx context.Context, db *sqlx.DB, steps int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(ctx, db, func(conn *sqlx.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		count := 0
+		for i := len(migrations) - 1; i >= 0 && count < steps; i-- {
+			m := migrations[i]
+			if !applied[m.Version] {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %d_%s has no down file", m.Version, m.Name)
+			}
+
+			slog.Info("Reverting migration", "version", m.Version, "name", m.Name)
+
+			err := runMigration(ctx, conn, m.Down, func(tx *sqlx.Tx) error {
+				_, err := tx.ExecContext(ctx, `
+					DELETE FROM schema_migrations
+					WHERE version = $1
+				`, m.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("could not revert migration %d_%s: %w", m.Version, m.Name, err)
+			}
+
+			count++
+		}
+
+		return nil
+	})
+}
+
+func withMigrationLock(ctx context.Context, db *sqlx.DB, fn func(conn *sqlx.Conn) error) (err error) {
+	// Session-level advisory locks belong to a connection, so lock, migrate and unlock on the same one.
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get connection: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationsLockID); err != nil {
+		return fmt.Errorf("could not acquire migrations lock: %w", err)
+	}
+	defer func() {
+		_, unlockErr := conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, migrationsLockID)
+		if unlockErr != nil {
+			err = errors.Join(err, fmt.Errorf("could not release migrations lock: %w", unlockErr))
+		}
+	}()
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		);
+	`)
+	if err != nil {
+		return fmt.Errorf("could not create schema_migrations table: %w", err)
+	}
+
+	return fn(conn)
+}
+
+func appliedMigrations(ctx context.Context, conn *sqlx.Conn) (map[int]bool, error) {
+	var versions []int
+	err := conn.SelectContext(ctx, &versions, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("could not get applied migrations: %w", err)
+	}
+
+	applied := make(map[int]bool, len(versions))
+	for _, v := range versions {
+		applied[v] = true
+	}
+
+	return applied, nil
+}
+
+func runMigration(ctx context.Context, conn *sqlx.Conn, query string, record func(tx *sqlx.Tx) error) (err error) {
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("could not begin transaction: %w", err)
+	}
+
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = errors.Join(err, rollbackErr)
+			}
+			return
+		}
+
+		err = tx.Commit()
+	}()
+
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	return record(tx)
+}
+
+// runMigrateCommand handles `project migrate up [N]` and `project migrate down [N]`.
+func runMigrateCommand(ctx context.Context, db *sqlx.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: migrate up|down [steps]")
+	}
+
+	steps := 0
+	if len(args) > 1 {
+		var err error
+		steps, err = strconv.Atoi(args[1])
+		if err != nil || steps < 0 {
+			return fmt.Errorf("invalid number of steps: %s", args[1])
+		}
+	}
+
+	switch args[0] {
+	case "up":
+		return MigrateUp(ctx, db, steps)
+	case "down":
+		if steps == 0 {
+			steps = 1
+		}
+		return MigrateDown(ctx, db, steps)
+	default:
+		return fmt.Errorf("unknown migrate command: %s", args[0])
+	}
+}
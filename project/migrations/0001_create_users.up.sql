@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS users (
+	id UUID PRIMARY KEY,
+	name TEXT NOT NULL,
+	email TEXT NOT NULL,
+	registered_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS "watermill_offsets_events_to_forward";
+DROP TABLE IF EXISTS "watermill_events_to_forward";
@@ -0,0 +1,18 @@
+-- Tables used by the watermill-sql Pub/Sub for the events_to_forward outbox topic.
+-- They must match watermillSQL.DefaultPostgreSQLSchema and DefaultPostgreSQLOffsetsAdapter.
+CREATE TABLE IF NOT EXISTS "watermill_events_to_forward" (
+	"offset" BIGSERIAL,
+	"uuid" VARCHAR(36) NOT NULL,
+	"created_at" TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	"payload" JSON DEFAULT NULL,
+	"metadata" JSON DEFAULT NULL,
+	"transaction_id" xid8 NOT NULL,
+	PRIMARY KEY ("transaction_id", "offset")
+);
+
+CREATE TABLE IF NOT EXISTS "watermill_offsets_events_to_forward" (
+	consumer_group VARCHAR(255) NOT NULL,
+	offset_acked BIGINT,
+	last_processed_transaction_id xid8 NOT NULL,
+	PRIMARY KEY(consumer_group)
+);
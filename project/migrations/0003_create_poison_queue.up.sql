@@ -0,0 +1,11 @@
+-- Messages that exhausted their handler retries. Written by watermill-sql, so it must match
+-- watermillSQL.DefaultPostgreSQLSchema for the poison topic.
+CREATE TABLE IF NOT EXISTS "watermill_poison" (
+	"offset" BIGSERIAL,
+	"uuid" VARCHAR(36) NOT NULL,
+	"created_at" TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	"payload" JSON DEFAULT NULL,
+	"metadata" JSON DEFAULT NULL,
+	"transaction_id" xid8 NOT NULL,
+	PRIMARY KEY ("transaction_id", "offset")
+);
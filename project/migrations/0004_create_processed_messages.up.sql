@@ -0,0 +1,6 @@
+CREATE TABLE IF NOT EXISTS processed_messages (
+	handler_name TEXT NOT NULL,
+	message_uuid TEXT NOT NULL,
+	processed_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY (handler_name, message_uuid)
+);
@@ -0,0 +1,27 @@
+-- Emails are compared case-insensitively; existing addresses are normalised the same way the API does it.
+--
+-- Users whose addresses are the same after normalising can't be merged automatically, so the migration
+-- fails with a list of them instead. Resolve them by hand and run it again.
+DO $$
+DECLARE
+	duplicates TEXT;
+BEGIN
+	SELECT string_agg(format('%s: users %s', email, user_ids), E'\n' ORDER BY email)
+	INTO duplicates
+	FROM (
+		SELECT lower(trim(email)) AS email, string_agg(id::text, ', ' ORDER BY registered_at, id) AS user_ids
+		FROM users
+		GROUP BY lower(trim(email))
+		HAVING count(*) > 1
+	) AS d;
+
+	IF duplicates IS NOT NULL THEN
+		RAISE EXCEPTION E'email addresses used by more than one user, they must be unique:\n%', duplicates
+			USING HINT = 'Change or remove all but one user of each address, then run the migration again.';
+	END IF;
+END
+$$;
+
+UPDATE users SET email = lower(trim(email));
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_key ON users (lower(email));
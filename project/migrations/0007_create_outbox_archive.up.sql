@@ -0,0 +1,11 @@
+-- Forwarded outbox rows moved here by the outbox cleaner when archiving is enabled.
+CREATE TABLE IF NOT EXISTS outbox_archive (
+	"offset" BIGINT NOT NULL,
+	"uuid" VARCHAR(36) NOT NULL,
+	"created_at" TIMESTAMP NOT NULL,
+	"payload" JSON DEFAULT NULL,
+	"metadata" JSON DEFAULT NULL,
+	"transaction_id" xid8 NOT NULL,
+	"archived_at" TIMESTAMPTZ NOT NULL DEFAULT now(),
+	PRIMARY KEY ("transaction_id", "offset")
+);
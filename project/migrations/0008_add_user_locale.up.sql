@@ -0,0 +1,2 @@
+-- Locale of the emails sent to the user.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locale TEXT NOT NULL DEFAULT 'en';
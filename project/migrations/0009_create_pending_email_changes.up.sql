@@ -0,0 +1,18 @@
+-- Email changes waiting for the user to confirm the new address.
+-- status is pending, confirmed, expired or superseded (by a newer change of the same user).
+CREATE TABLE IF NOT EXISTS pending_email_changes (
+	id UUID PRIMARY KEY,
+	user_id UUID NOT NULL REFERENCES users (id),
+	old_email TEXT NOT NULL,
+	new_email TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	requested_at TIMESTAMPTZ NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL,
+	resolved_at TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS pending_email_changes_user_pending_key
+	ON pending_email_changes (user_id) WHERE status = 'pending';
+
+CREATE INDEX IF NOT EXISTS pending_email_changes_expires_at_idx
+	ON pending_email_changes (expires_at) WHERE status = 'pending';
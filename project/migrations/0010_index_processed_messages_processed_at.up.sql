@@ -0,0 +1,2 @@
+-- Lets the processed messages cleaner find markers older than the retention.
+CREATE INDEX IF NOT EXISTS processed_messages_processed_at_idx ON processed_messages (processed_at);
@@ -0,0 +1,15 @@
+-- Users waiting to be sent to the CRM in a bulk request, when CRM batching is enabled.
+-- A user that failed for good keeps its row with failed_at set.
+CREATE TABLE IF NOT EXISTS crm_user_queue (
+	user_id UUID PRIMARY KEY,
+	name TEXT NOT NULL,
+	email TEXT NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	last_error TEXT,
+	failed_at TIMESTAMPTZ,
+	enqueued_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS crm_user_queue_next_attempt_at_idx
+	ON crm_user_queue (next_attempt_at) WHERE failed_at IS NULL;
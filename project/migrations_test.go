@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestMigrateUp_duplicateEmails(t *testing.T) {
+	db := newEmptyTestDB(t)
+	ctx := context.Background()
+
+	// Up to the migration before the unique email index.
+	if err := MigrateUp(ctx, db, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	first := uuid.Must(uuid.NewV7())
+	second := uuid.Must(uuid.NewV7())
+	other := uuid.Must(uuid.NewV7())
+	now := time.Now()
+
+	_, err := db.ExecContext(ctx, `
+		INSERT INTO users (id, name, email, registered_at)
+		VALUES
+			($1, 'First', 'User@Example.com', $4),
+			($2, 'Second', ' user@example.com', $5),
+			($3, 'Other', 'other@example.com', $4)
+	`, first, second, other, now, now.Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = MigrateDB(ctx, db)
+	if err == nil {
+		t.Fatal("expected the migration to fail on duplicate emails")
+	}
+	expected := "user@example.com: users " + first.String() + ", " + second.String()
+	if !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected error to contain %q, got: %v", expected, err)
+	}
+	if strings.Contains(err.Error(), other.String()) {
+		t.Errorf("error lists a user without a duplicate email: %v", err)
+	}
+
+	if _, err := db.ExecContext(ctx, `UPDATE users SET email = 'second@example.com' WHERE id = $1`, second); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateDB(ctx, db); err != nil {
+		t.Fatalf("expected the migration to succeed once duplicates are resolved: %v", err)
+	}
+
+	var email string
+	if err := db.GetContext(ctx, &email, `SELECT email FROM users WHERE id = $1`, first); err != nil {
+		t.Fatal(err)
+	}
+	if email != "user@example.com" {
+		t.Errorf("expected the email to be normalised, got %q", email)
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("expected migration %d to have version %d, got %d_%s", i, i+1, m.Version, m.Name)
+		}
+		if m.Down == "" {
+			t.Errorf("migration %d_%s has no down file", m.Version, m.Name)
+		}
+	}
+}
+
+// schemaSnapshot describes the tables, columns and indexes created by migrations.
+func schemaSnapshot(t *testing.T, db *sqlx.DB) []string {
+	t.Helper()
+
+	var snapshot []string
+	err := db.Select(&snapshot, `
+		SELECT format('column %s.%s %s %s %s', table_name, column_name, data_type, is_nullable, coalesce(column_default, ''))
+		FROM information_schema.columns
+		WHERE table_schema = 'public' AND table_name <> 'schema_migrations'
+		UNION ALL
+		SELECT format('index %s', indexdef)
+		FROM pg_indexes
+		WHERE schemaname = 'public' AND tablename <> 'schema_migrations'
+		ORDER BY 1
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func appliedVersions(t *testing.T, db *sqlx.DB) []int {
+	t.Helper()
+
+	var versions []int
+	if err := db.Select(&versions, `SELECT version FROM schema_migrations ORDER BY version`); err != nil {
+		t.Fatal(err)
+	}
+	return versions
+}
+
+func TestMigrate_upDownUp(t *testing.T) {
+	db := newEmptyTestDB(t)
+	ctx := context.Background()
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateDB(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	migrated := schemaSnapshot(t, db)
+	if n := len(appliedVersions(t, db)); n != len(migrations) {
+		t.Fatalf("expected %d applied migrations, got %d", len(migrations), n)
+	}
+
+	// Running them again does nothing.
+	if err := MigrateDB(ctx, db); err != nil {
+		t.Fatalf("re-running migrations failed: %v", err)
+	}
+	if n := len(appliedVersions(t, db)); n != len(migrations) {
+		t.Fatalf("expected %d applied migrations after a re-run, got %d", len(migrations), n)
+	}
+
+	if err := MigrateDown(ctx, db, len(migrations)); err != nil {
+		t.Fatal(err)
+	}
+	if versions := appliedVersions(t, db); len(versions) != 0 {
+		t.Errorf("expected no applied migrations, got %v", versions)
+	}
+	if snapshot := schemaSnapshot(t, db); len(snapshot) != 0 {
+		t.Errorf("expected down migrations to remove everything, left:\n%s", strings.Join(snapshot, "\n"))
+	}
+
+	if err := MigrateDB(ctx, db); err != nil {
+		t.Fatalf("migrating up again failed: %v", err)
+	}
+	if remigrated := schemaSnapshot(t, db); !slices.Equal(remigrated, migrated) {
+		t.Errorf("schema differs after up, down and up again\nfirst:\n%s\nsecond:\n%s",
+			strings.Join(migrated, "\n"), strings.Join(remigrated, "\n"))
+	}
+}
+
+func TestMigrate_concurrent(t *testing.T) {
+	db := newEmptyTestDB(t)
+	ctx := context.Background()
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the lock like another replica in the middle of migrating.
+	conn, err := db.Connx(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationsLockID); err != nil {
+		t.Fatal(err)
+	}
+
+	const runners = 2
+	errs := make(chan error, runners)
+	for range runners {
+		go func() {
+			errs <- MigrateDB(ctx, db)
+		}()
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatalf("migrations ran while the lock was held: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationsLockID); err != nil {
+		t.Fatal(err)
+	}
+
+	for range runners {
+		if err := <-errs; err != nil {
+			t.Errorf("concurrent migration failed: %v", err)
+		}
+	}
+
+	versions := appliedVersions(t, db)
+	if len(versions) != len(migrations) {
+		t.Errorf("expected each of %d migrations to be applied once, got %v", len(migrations), versions)
+	}
+
+	var locks int
+	err = db.Get(&locks, `SELECT count(*) FROM pg_locks WHERE locktype = 'advisory' AND objid = $1`, migrationsLockID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locks != 0 {
+		t.Errorf("expected the migrations lock to be released, %d held", locks)
+	}
+}
@@ -2,9 +2,13 @@ package main
 
 import (
 	"context"
-	"os"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
-	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill"
 	watermillSQL "github.com/ThreeDotsLabs/watermill-sql/v4/pkg/sql"
 	"github.com/ThreeDotsLabs/watermill/components/cqrs"
 	"github.com/ThreeDotsLabs/watermill/components/forwarder"
@@ -13,17 +17,30 @@ import (
 
 const outboxTopic = "events_to_forward"
 
-func PublishEventInTx(ctx context.Context, event Event, tx *sqlx.Tx) error {
+// outboxConsumerGroup is the consumer group of the forwarder's SQL subscriber.
+const outboxConsumerGroup = ""
 
-	logger := newWatermillLogger()
+type outboxTxContextKey struct{}
+
+// Outbox publishes events to the SQL outbox table within the caller's transaction.
+//
+// The publisher and event bus are built once; the transaction is carried in the
+// message context and picked up by txFromContextExecutor on insert.
+type Outbox struct {
+	eventBus *cqrs.EventBus
+
+	mu       sync.Mutex
+	closed   bool
+	inFlight sync.WaitGroup
+}
 
-	pub, err := watermillSQL.NewPublisher(watermillSQL.TxFromStdSQL(tx.Tx),
+func NewOutbox(logger watermill.LoggerAdapter) (*Outbox, error) {
+	pub, err := watermillSQL.NewPublisher(txFromContextExecutor{},
 		watermillSQL.PublisherConfig{
 			SchemaAdapter: watermillSQL.DefaultPostgreSQLSchema{},
 		}, logger)
-
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	frw := forwarder.NewPublisher(pub, forwarder.PublisherConfig{
@@ -32,62 +49,174 @@ func PublishEventInTx(ctx context.Context, event Event, tx *sqlx.Tx) error {
 
 	eb, err := cqrs.NewEventBusWithConfig(frw, cqrs.EventBusConfig{
 		GeneratePublishTopic: func(geptp cqrs.GenerateEventPublishTopicParams) (string, error) {
-			return "events", nil
+			return topic, nil
 		},
+		OnPublish: onEventPublish,
 		Marshaler: CQRSMarshaler,
 	})
-
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return eb.Publish(ctx, event)
+	return &Outbox{
+		eventBus: eb,
+	}, nil
+}
+
+// ErrOutboxClosed is returned by UpdateInTx once shutdown started waiting for outbox transactions.
+var ErrOutboxClosed = errors.New("outbox is closed")
+
+// UpdateInTx wraps UpdateInTx for transactions that publish to the outbox.
+// The transaction is tracked, so shutdown can wait for it with Wait.
+func (o *Outbox) UpdateInTx(
+	ctx context.Context,
+	db *sqlx.DB,
+	isolation sql.IsolationLevel,
+	fn func(ctx context.Context, tx *sqlx.Tx) error,
+) error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return ErrOutboxClosed
+	}
+	o.inFlight.Add(1)
+	o.mu.Unlock()
 
+	defer o.inFlight.Done()
+
+	return UpdateInTx(ctx, db, isolation, fn)
 }
 
+// Wait stops new outbox transactions from starting, and blocks until the in-flight ones
+// are finished, or ctx is done.
+func (o *Outbox) Wait(ctx context.Context) error {
+	o.mu.Lock()
+	o.closed = true
+	o.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		o.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-func RunForwarder(ctx context.Context, db *sqlx.DB) error {
-	logger := newWatermillLogger()
+func (o *Outbox) PublishInTx(ctx context.Context, event Event, tx *sqlx.Tx) (err error) {
+	ctx, span := tracer().Start(ctx, "outbox.publish")
+	defer func() {
+		endSpan(span, err)
+	}()
 
-	sub, err := watermillSQL.NewSubscriber(
-		watermillSQL.BeginnerFromStdSQL(db.DB),
-		watermillSQL.SubscriberConfig{
-			InitializeSchema: true,
-			SchemaAdapter: watermillSQL.DefaultPostgreSQLSchema{},
-			OffsetsAdapter: watermillSQL.DefaultPostgreSQLOffsetsAdapter{},
-		}, logger,
-	)
+	ctx = context.WithValue(ctx, outboxTxContextKey{}, watermillSQL.TxFromStdSQL(tx.Tx))
+	return o.eventBus.Publish(ctx, event)
+}
 
+// txFromContextExecutor runs the outbox insert on the transaction stored in the message context.
+type txFromContextExecutor struct{}
+
+func (txFromContextExecutor) ExecContext(ctx context.Context, query string, args ...any) (watermillSQL.Result, error) {
+	tx, err := outboxTxFromContext(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return tx.ExecContext(ctx, query, args...)
+}
 
-	err = sub.SubscribeInitialize(outboxTopic)
+func (txFromContextExecutor) QueryContext(ctx context.Context, query string, args ...any) (watermillSQL.Rows, error) {
+	tx, err := outboxTxFromContext(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	return tx.QueryContext(ctx, query, args...)
+}
+
+func outboxTxFromContext(ctx context.Context) (watermillSQL.Tx, error) {
+	tx, ok := ctx.Value(outboxTxContextKey{}).(watermillSQL.Tx)
+	if !ok {
+		return nil, errors.New("outbox publish called without a transaction")
 	}
+	return tx, nil
+}
+
+// NewForwarder creates the forwarder moving events from the outbox table to the Pub/Sub.
+// On Close, it waits up to closeTimeout for the message being forwarded.
+func NewForwarder(db *sqlx.DB, pubSub *PubSub, closeTimeout time.Duration) (*forwarder.Forwarder, error) {
+	logger := newWatermillLogger()
 
-	pub, err := kafka.NewPublisher(kafka.PublisherConfig{
-		Brokers: []string{os.Getenv("KAFKA_ADDR")},
-		Marshaler: KafkaMarshaler,
-	}, logger)
+	sub, err := watermillSQL.NewSubscriber(
+		watermillSQL.BeginnerFromStdSQL(db.DB),
+		watermillSQL.SubscriberConfig{
+			ConsumerGroup:  outboxConsumerGroup,
+			SchemaAdapter:  watermillSQL.DefaultPostgreSQLSchema{},
+			OffsetsAdapter: watermillSQL.DefaultPostgreSQLOffsetsAdapter{},
+		}, logger,
+	)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	fwd, err := forwarder.NewForwarder(
+	return forwarder.NewForwarder(
 		sub,
-		pub, 
+		tracingPublisher{Publisher: pubSub.Publisher(), spanName: "forwarder.forward"},
 		logger,
 		forwarder.Config{
 			ForwarderTopic: outboxTopic,
+			CloseTimeout:   closeTimeout,
 		},
 	)
+}
 
+type OutboxStats struct {
+	Messages         int64
+	PendingMessages  int64
+	OldestPendingAge time.Duration
+}
+
+// GetOutboxStats counts outbox rows and the rows after the forwarder's committed offset.
+func GetOutboxStats(ctx context.Context, db *sqlx.DB) (OutboxStats, error) {
+	var row struct {
+		Messages                int64   `db:"messages"`
+		PendingMessages         int64   `db:"pending_messages"`
+		OldestPendingAgeSeconds float64 `db:"oldest_pending_age_seconds"`
+	}
+
+	// The condition mirrors how watermill-sql picks the next rows for a consumer group.
+	// created_at has no time zone, so the age is computed in the same session time zone it was written in.
+	err := db.GetContext(ctx, &row, `
+		WITH consumer AS (
+			SELECT offset_acked, last_processed_transaction_id
+			FROM "watermill_offsets_events_to_forward"
+			WHERE consumer_group = $1
+		),
+		pending AS (
+			SELECT m.created_at
+			FROM "watermill_events_to_forward" m
+			WHERE NOT EXISTS (
+				SELECT 1 FROM consumer c
+				WHERE m.transaction_id < c.last_processed_transaction_id
+					OR (m.transaction_id = c.last_processed_transaction_id AND m."offset" <= c.offset_acked)
+			)
+		)
+		SELECT
+			(SELECT count(*) FROM "watermill_events_to_forward") AS messages,
+			(SELECT count(*) FROM pending) AS pending_messages,
+			COALESCE(EXTRACT(EPOCH FROM (LOCALTIMESTAMP - (SELECT min(created_at) FROM pending))), 0) AS oldest_pending_age_seconds
+	`, outboxConsumerGroup)
 	if err != nil {
-		return err
+		return OutboxStats{}, fmt.Errorf("failed to get outbox stats: %w", err)
 	}
 
-	return fwd.Run(ctx)
-}
\ No newline at end of file
+	return OutboxStats{
+		Messages:         row.Messages,
+		PendingMessages:  row.PendingMessages,
+		OldestPendingAge: time.Duration(row.OldestPendingAgeSeconds * float64(time.Second)),
+	}, nil
+}
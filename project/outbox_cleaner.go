@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type OutboxCleanerConfig struct {
+	// Interval between cleanup runs.
+	Interval time.Duration `yaml:"interval"`
+
+	// Retention is how long forwarded messages are kept.
+	Retention time.Duration `yaml:"retention"`
+
+	// BatchSize limits the rows removed by one statement, so the outbox table is never locked for long.
+	BatchSize int `yaml:"batch_size"`
+
+	// Archive moves removed rows to outbox_archive instead of deleting them.
+	Archive bool `yaml:"archive"`
+}
+
+func DefaultOutboxCleanerConfig() OutboxCleanerConfig {
+	return OutboxCleanerConfig{
+		Interval:  time.Hour,
+		Retention: 7 * 24 * time.Hour,
+		BatchSize: 1000,
+	}
+}
+
+var outboxCleanedRowsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "outbox",
+		Name:      "cleaned_rows_total",
+		Help:      "Forwarded outbox rows deleted or archived by the outbox cleaner.",
+	},
+)
+
+// OutboxCleaner removes forwarded messages from the outbox table once they are older than the retention.
+// Only rows up to the forwarder's committed offset are removed.
+type OutboxCleaner struct {
+	db     *sqlx.DB
+	config OutboxCleanerConfig
+}
+
+func NewOutboxCleaner(db *sqlx.DB, config OutboxCleanerConfig) *OutboxCleaner {
+	return &OutboxCleaner{
+		db:     db,
+		config: config,
+	}
+}
+
+func (c *OutboxCleaner) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := c.Clean(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.With("error", err).Error("Failed to clean outbox")
+		}
+		if removed > 0 {
+			slog.Info("Cleaned outbox", "removed_rows", removed, "archived", c.config.Archive)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Clean removes all forwarded rows older than the retention, one batch at a time,
+// and returns the number of rows removed.
+func (c *OutboxCleaner) Clean(ctx context.Context) (int64, error) {
+	var total int64
+
+	for {
+		removed, err := c.cleanBatch(ctx)
+		total += removed
+		outboxCleanedRowsTotal.Add(float64(removed))
+
+		if err != nil {
+			return total, err
+		}
+		if removed < int64(c.config.BatchSize) {
+			return total, nil
+		}
+	}
+}
+
+// outboxForwardedBatchQuery selects up to $3 forwarded rows older than $2 seconds.
+//
+// The forwarded condition mirrors GetOutboxStats: rows at or before the committed
+// (transaction_id, offset) of the forwarder's consumer group ($1).
+// Without an offsets row nothing is forwarded yet, so nothing is selected.
+const outboxForwardedBatchQuery = `
+	WITH consumer AS (
+		SELECT offset_acked, last_processed_transaction_id
+		FROM "watermill_offsets_events_to_forward"
+		WHERE consumer_group = $1
+	),
+	batch AS (
+		SELECT m.transaction_id, m."offset"
+		FROM "watermill_events_to_forward" m, consumer c
+		WHERE (
+				m.transaction_id < c.last_processed_transaction_id
+				OR (m.transaction_id = c.last_processed_transaction_id AND m."offset" <= c.offset_acked)
+			)
+			AND m.created_at < LOCALTIMESTAMP - make_interval(secs => $2)
+		ORDER BY m.transaction_id, m."offset"
+		LIMIT $3
+		FOR UPDATE OF m SKIP LOCKED
+	),
+	deleted AS (
+		DELETE FROM "watermill_events_to_forward" m
+		USING batch b
+		WHERE m.transaction_id = b.transaction_id AND m."offset" = b."offset"
+		RETURNING m.*
+	)
+`
+
+const outboxDeleteBatchQuery = outboxForwardedBatchQuery + `
+	SELECT count(*) FROM deleted
+`
+
+const outboxArchiveBatchQuery = outboxForwardedBatchQuery + `
+	, archived AS (
+		INSERT INTO outbox_archive ("offset", uuid, created_at, payload, metadata, transaction_id)
+		SELECT "offset", uuid, created_at, payload, metadata, transaction_id
+		FROM deleted
+		RETURNING 1
+	)
+	SELECT count(*) FROM archived
+`
+
+func (c *OutboxCleaner) cleanBatch(ctx context.Context) (int64, error) {
+	query := outboxDeleteBatchQuery
+	if c.config.Archive {
+		query = outboxArchiveBatchQuery
+	}
+
+	var removed int64
+	err := c.db.GetContext(ctx, &removed, query, outboxConsumerGroup, c.config.Retention.Seconds(), c.config.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to clean outbox batch: %w", err)
+	}
+
+	return removed, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOutboxCleaner_Clean(t *testing.T) {
+	for _, archive := range []bool{false, true} {
+		name := "delete"
+		if archive {
+			name = "archive"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			db := newTestDB(t)
+			ctx := context.Background()
+
+			insertOutboxFixture(t, db)
+
+			cleaner := NewOutboxCleaner(db, OutboxCleanerConfig{
+				Retention: time.Hour,
+				BatchSize: 2,
+				Archive:   archive,
+			})
+
+			removed, err := cleaner.Clean(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != 3 {
+				t.Errorf("expected 3 removed rows, got %d", removed)
+			}
+
+			// Rows after the committed offset are kept however old they are, and so are recent rows.
+			var remaining []string
+			if err := db.Select(&remaining, `SELECT uuid FROM "watermill_events_to_forward" ORDER BY uuid`); err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"forwarded-recent", "pending-1", "pending-2"}; !slices.Equal(remaining, want) {
+				t.Errorf("expected %v to remain, got %v", want, remaining)
+			}
+
+			var archived []string
+			if err := db.Select(&archived, `SELECT uuid FROM outbox_archive ORDER BY uuid`); err != nil {
+				t.Fatal(err)
+			}
+			var wantArchived []string
+			if archive {
+				wantArchived = []string{"forwarded-1", "forwarded-2", "forwarded-3"}
+			}
+			if !slices.Equal(archived, wantArchived) {
+				t.Errorf("expected %v to be archived, got %v", wantArchived, archived)
+			}
+		})
+	}
+}
+
+func TestOutboxCleaner_Clean_nothingForwarded(t *testing.T) {
+	db := newTestDB(t)
+
+	_, err := db.Exec(`
+		INSERT INTO "watermill_events_to_forward" (transaction_id, "offset", uuid, created_at)
+		VALUES ('100', 1, 'pending-1', LOCALTIMESTAMP - interval '2 hours')
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleaner := NewOutboxCleaner(db, OutboxCleanerConfig{Retention: time.Hour, BatchSize: 10})
+
+	removed, err := cleaner.Clean(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 0 {
+		t.Errorf("expected nothing to be removed without a committed offset, got %d rows", removed)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type OutboxMonitorConfig struct {
+	// Interval between outbox checks.
+	Interval time.Duration `yaml:"interval"`
+
+	// The outbox is lagging when the oldest pending message is older than MaxPendingAge,
+	// or when more than MaxPendingMessages are pending. Zero disables a threshold.
+	MaxPendingAge      time.Duration `yaml:"max_pending_age"`
+	MaxPendingMessages int64         `yaml:"max_pending_messages"`
+
+	// DegradeHealth makes /health report degraded while the outbox is lagging.
+	DegradeHealth bool `yaml:"degrade_health"`
+}
+
+func DefaultOutboxMonitorConfig() OutboxMonitorConfig {
+	return OutboxMonitorConfig{
+		Interval:           15 * time.Second,
+		MaxPendingAge:      time.Minute,
+		MaxPendingMessages: 1000,
+		DegradeHealth:      true,
+	}
+}
+
+type OutboxStatus struct {
+	Messages                int64     `json:"messages"`
+	PendingMessages         int64     `json:"pending_messages"`
+	OldestPendingAgeSeconds float64   `json:"oldest_pending_age_seconds"`
+	Lagging                 bool      `json:"lagging"`
+	CheckedAt               time.Time `json:"checked_at"`
+	Error                   string    `json:"error,omitempty"`
+}
+
+// OutboxMonitor periodically checks how far the forwarder is behind the outbox table,
+// so a stalled forwarder doesn't go unnoticed.
+type OutboxMonitor struct {
+	db     *sqlx.DB
+	config OutboxMonitorConfig
+
+	mu     sync.RWMutex
+	status OutboxStatus
+}
+
+func NewOutboxMonitor(db *sqlx.DB, config OutboxMonitorConfig) *OutboxMonitor {
+	return &OutboxMonitor{
+		db:     db,
+		config: config,
+	}
+}
+
+func (m *OutboxMonitor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		m.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *OutboxMonitor) check(ctx context.Context) {
+	status := OutboxStatus{
+		CheckedAt: time.Now().UTC(),
+	}
+
+	stats, err := GetOutboxStats(ctx, m.db)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		slog.With("error", err).Error("Failed to check outbox lag")
+		status.Error = err.Error()
+	} else {
+		status.Messages = stats.Messages
+		status.PendingMessages = stats.PendingMessages
+		status.OldestPendingAgeSeconds = stats.OldestPendingAge.Seconds()
+		status.Lagging = m.isLagging(stats)
+	}
+
+	m.mu.Lock()
+	wasLagging := m.status.Lagging
+	if err != nil {
+		// Keep the last known state when the check itself failed.
+		status.Lagging = wasLagging
+	}
+	m.status = status
+	m.mu.Unlock()
+
+	logger := slog.With(
+		"pending_messages", status.PendingMessages,
+		"oldest_pending_age", stats.OldestPendingAge.String(),
+	)
+	if status.Lagging && !wasLagging {
+		logger.Warn("Outbox forwarder is lagging")
+	} else if !status.Lagging && wasLagging {
+		logger.Info("Outbox forwarder caught up")
+	}
+}
+
+func (m *OutboxMonitor) isLagging(stats OutboxStats) bool {
+	if m.config.MaxPendingAge > 0 && stats.OldestPendingAge > m.config.MaxPendingAge {
+		return true
+	}
+	if m.config.MaxPendingMessages > 0 && stats.PendingMessages > m.config.MaxPendingMessages {
+		return true
+	}
+	return false
+}
+
+func (m *OutboxMonitor) Status() OutboxStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.status
+}
+
+// Degraded reports whether /health should report degraded.
+func (m *OutboxMonitor) Degraded() bool {
+	return m.config.DegradeHealth && m.Status().Lagging
+}
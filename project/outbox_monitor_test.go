@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// insertOutboxFixture fills the outbox with rows on both sides of the forwarder's committed offset,
+// at transaction 200 and offset 5:
+//
+//	forwarded: (100, 1) and (200, 4), (200, 5) created 2 hours ago, (100, 2) created a minute ago
+//	pending:   (200, 6) and (300, 7) created 2 hours ago
+func insertOutboxFixture(t *testing.T, db *sqlx.DB) {
+	t.Helper()
+
+	_, err := db.Exec(`
+		INSERT INTO "watermill_events_to_forward" (transaction_id, "offset", uuid, created_at)
+		VALUES
+			('100', 1, 'forwarded-1', LOCALTIMESTAMP - interval '2 hours'),
+			('100', 2, 'forwarded-recent', LOCALTIMESTAMP - interval '1 minute'),
+			('200', 4, 'forwarded-2', LOCALTIMESTAMP - interval '2 hours'),
+			('200', 5, 'forwarded-3', LOCALTIMESTAMP - interval '2 hours'),
+			('200', 6, 'pending-1', LOCALTIMESTAMP - interval '2 hours'),
+			('300', 7, 'pending-2', LOCALTIMESTAMP - interval '2 hours');
+
+		INSERT INTO "watermill_offsets_events_to_forward" (consumer_group, offset_acked, last_processed_transaction_id)
+		VALUES ('', 5, '200');
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetOutboxStats(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	stats, err := GetOutboxStats(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (OutboxStats{}) {
+		t.Errorf("expected empty stats for an empty outbox, got %+v", stats)
+	}
+
+	insertOutboxFixture(t, db)
+
+	stats, err = GetOutboxStats(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Messages != 6 {
+		t.Errorf("expected 6 messages, got %d", stats.Messages)
+	}
+	if stats.PendingMessages != 2 {
+		t.Errorf("expected 2 pending messages, got %d", stats.PendingMessages)
+	}
+	if stats.OldestPendingAge < 2*time.Hour || stats.OldestPendingAge > 2*time.Hour+time.Minute {
+		t.Errorf("expected the oldest pending message to be 2 hours old, got %s", stats.OldestPendingAge)
+	}
+}
+
+func TestGetOutboxStats_nothingForwarded(t *testing.T) {
+	db := newTestDB(t)
+
+	_, err := db.Exec(`
+		INSERT INTO "watermill_events_to_forward" (transaction_id, "offset", uuid)
+		VALUES ('100', 1, 'pending-1'), ('100', 2, 'pending-2')
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without an offsets row, every message is pending.
+	stats, err := GetOutboxStats(context.Background(), db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Messages != 2 || stats.PendingMessages != 2 {
+		t.Errorf("expected 2 pending messages, got %+v", stats)
+	}
+}
+
+func TestOutboxMonitor_isLagging(t *testing.T) {
+	config := OutboxMonitorConfig{
+		MaxPendingAge:      time.Minute,
+		MaxPendingMessages: 10,
+	}
+
+	testCases := []struct {
+		name   string
+		config OutboxMonitorConfig
+		stats  OutboxStats
+		want   bool
+	}{
+		{
+			name:   "caught_up",
+			config: config,
+			stats:  OutboxStats{PendingMessages: 10, OldestPendingAge: time.Minute},
+			want:   false,
+		},
+		{
+			name:   "old_pending_message",
+			config: config,
+			stats:  OutboxStats{PendingMessages: 1, OldestPendingAge: time.Minute + time.Second},
+			want:   true,
+		},
+		{
+			name:   "too_many_pending_messages",
+			config: config,
+			stats:  OutboxStats{PendingMessages: 11},
+			want:   true,
+		},
+		{
+			name:   "thresholds_disabled",
+			config: OutboxMonitorConfig{},
+			stats:  OutboxStats{PendingMessages: 1000, OldestPendingAge: time.Hour},
+			want:   false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			monitor := NewOutboxMonitor(nil, tc.config)
+			if got := monitor.isLagging(tc.stats); got != tc.want {
+				t.Errorf("expected lagging %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestOutboxMonitor_check(t *testing.T) {
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	insertOutboxFixture(t, db)
+
+	config := DefaultOutboxMonitorConfig()
+	config.MaxPendingAge = time.Hour
+	monitor := NewOutboxMonitor(db, config)
+
+	monitor.check(ctx)
+
+	status := monitor.Status()
+	if status.Error != "" {
+		t.Fatalf("check failed: %s", status.Error)
+	}
+	if status.Messages != 6 || status.PendingMessages != 2 || !status.Lagging {
+		t.Errorf("expected 2 of 6 messages pending and lagging, got %+v", status)
+	}
+	if !monitor.Degraded() {
+		t.Error("expected health to be degraded")
+	}
+
+	// A failed check keeps the last known state.
+	if _, err := db.Exec(`ALTER TABLE "watermill_events_to_forward" RENAME TO "outbox_unavailable"`); err != nil {
+		t.Fatal(err)
+	}
+	monitor.check(ctx)
+
+	status = monitor.Status()
+	if status.Error == "" || !status.Lagging {
+		t.Errorf("expected the error to be reported and the lag kept, got %+v", status)
+	}
+}
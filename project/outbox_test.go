@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"testing"
+	"time"
+
+	watermillSQL "github.com/ThreeDotsLabs/watermill-sql/v4/pkg/sql"
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/components/forwarder"
+	"github.com/gofrs/uuid/v5"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestOutbox_Wait(t *testing.T) {
+	db := sqlx.NewDb(sql.OpenDB(noopConnector{}), "pgx")
+	defer db.Close()
+
+	outbox, err := NewOutbox(newWatermillLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	txDone := make(chan error, 1)
+	go func() {
+		txDone <- outbox.UpdateInTx(ctx, db, sql.LevelReadCommitted, func(ctx context.Context, tx *sqlx.Tx) error {
+			close(started)
+			<-release
+			return nil
+		})
+	}()
+	<-started
+
+	waitDone := make(chan error, 1)
+	go func() {
+		waitDone <- outbox.Wait(ctx)
+	}()
+
+	select {
+	case <-waitDone:
+		t.Fatal("Wait returned while a transaction is in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Transactions started after Wait are rejected, so the wait can't be extended.
+	err = outbox.UpdateInTx(ctx, db, sql.LevelReadCommitted, func(ctx context.Context, tx *sqlx.Tx) error {
+		t.Error("transaction started after Wait")
+		return nil
+	})
+	if !errors.Is(err, ErrOutboxClosed) {
+		t.Errorf("expected ErrOutboxClosed, got %v", err)
+	}
+
+	close(release)
+	if err := <-txDone; err != nil {
+		t.Errorf("in-flight transaction failed: %v", err)
+	}
+
+	select {
+	case err := <-waitDone:
+		if err != nil {
+			t.Errorf("Wait failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Wait didn't return after the transaction finished")
+	}
+}
+
+// BenchmarkPublishInTx compares the shared event bus with building the publisher,
+// forwarder publisher and event bus on every call, like PublishInTx did before.
+// The database driver does nothing, so only the work done in the service is measured.
+func BenchmarkPublishInTx(b *testing.B) {
+	db := sqlx.NewDb(sql.OpenDB(noopConnector{}), "pgx")
+	defer db.Close()
+
+	ctx := context.Background()
+	event := UserRegistered{
+		UserID:       uuid.Must(uuid.NewV7()),
+		Name:         "Test User",
+		Email:        "user@example.com",
+		Locale:       DefaultLocale,
+		RegisteredAt: time.Now().UTC(),
+	}
+
+	tx, err := db.BeginTxx(ctx, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer tx.Rollback()
+
+	b.Run("shared", func(b *testing.B) {
+		outbox, err := NewOutbox(newWatermillLogger())
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := outbox.PublishInTx(ctx, event, tx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("per_call", func(b *testing.B) {
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := publishInTxPerCall(ctx, event, tx); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// publishInTxPerCall is how events were published before the event bus was shared.
+func publishInTxPerCall(ctx context.Context, event Event, tx *sqlx.Tx) error {
+	pub, err := watermillSQL.NewPublisher(watermillSQL.TxFromStdSQL(tx.Tx),
+		watermillSQL.PublisherConfig{
+			SchemaAdapter: watermillSQL.DefaultPostgreSQLSchema{},
+		}, newWatermillLogger())
+	if err != nil {
+		return err
+	}
+
+	frw := forwarder.NewPublisher(pub, forwarder.PublisherConfig{
+		ForwarderTopic: outboxTopic,
+	})
+
+	eb, err := cqrs.NewEventBusWithConfig(frw, cqrs.EventBusConfig{
+		GeneratePublishTopic: func(geptp cqrs.GenerateEventPublishTopicParams) (string, error) {
+			return topic, nil
+		},
+		OnPublish: onEventPublish,
+		Marshaler: CQRSMarshaler,
+	})
+	if err != nil {
+		return err
+	}
+
+	return eb.Publish(ctx, event)
+}
+
+// noopConnector is a database/sql driver that accepts every statement without doing anything.
+type noopConnector struct{}
+
+func (c noopConnector) Connect(context.Context) (driver.Conn, error) { return noopConn{}, nil }
+func (c noopConnector) Driver() driver.Driver                        { return c }
+func (c noopConnector) Open(string) (driver.Conn, error)             { return noopConn{}, nil }
+
+type noopConn struct{}
+
+func (noopConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+func (noopConn) Close() error              { return nil }
+func (noopConn) Begin() (driver.Tx, error) { return noopTx{}, nil }
+
+func (noopConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return noopTx{}, nil
+}
+
+func (noopConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+func (noopConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+type noopTx struct{}
+
+func (noopTx) Commit() error   { return nil }
+func (noopTx) Rollback() error { return nil }
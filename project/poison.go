@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	watermillSQL "github.com/ThreeDotsLabs/watermill-sql/v4/pkg/sql"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/jmoiron/sqlx"
+)
+
+// poisonTopic receives messages whose handler kept failing after all retries.
+// It's stored in Postgres regardless of the Pub/Sub backend, so poisoned messages can be listed and republished.
+const poisonTopic = "poison"
+
+var poisonMetadataKeys = []string{
+	middleware.ReasonForPoisonedKey,
+	middleware.PoisonedTopicKey,
+	middleware.PoisonedHandlerKey,
+	middleware.PoisonedSubscriberKey,
+}
+
+type RetryConfig struct {
+	MaxRetries      int           `yaml:"max_retries"`
+	InitialInterval time.Duration `yaml:"initial_interval"`
+	MaxInterval     time.Duration `yaml:"max_interval"`
+}
+
+// HandlerRetryConfigs holds the retry policy for each handler, by name.
+// Handlers without an entry use Default.
+type HandlerRetryConfigs struct {
+	Default    RetryConfig            `yaml:"default"`
+	PerHandler map[string]RetryConfig `yaml:"per_handler"`
+}
+
+func DefaultHandlerRetryConfigs() HandlerRetryConfigs {
+	return HandlerRetryConfigs{
+		Default: RetryConfig{
+			MaxRetries:      5,
+			InitialInterval: 100 * time.Millisecond,
+			MaxInterval:     5 * time.Second,
+		},
+		PerHandler: map[string]RetryConfig{
+			"AddToCRM": {
+				MaxRetries:      10,
+				InitialInterval: 500 * time.Millisecond,
+				MaxInterval:     30 * time.Second,
+			},
+		},
+	}
+}
+
+func (c HandlerRetryConfigs) ForHandler(handlerName string) RetryConfig {
+	if cfg, ok := c.PerHandler[handlerName]; ok {
+		return cfg
+	}
+	return c.Default
+}
+
+// Middleware retries the handler with the policy configured for its name.
+func (c HandlerRetryConfigs) Middleware(logger watermill.LoggerAdapter) message.HandlerMiddleware {
+	return func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			cfg := c.ForHandler(message.HandlerNameFromCtx(msg.Context()))
+
+			retry := middleware.Retry{
+				MaxRetries:      cfg.MaxRetries,
+				InitialInterval: cfg.InitialInterval,
+				MaxInterval:     cfg.MaxInterval,
+				Multiplier:      2,
+				// Errors that can't succeed on retry go straight to the poison queue.
+				ShouldRetry: func(params middleware.RetryParams) bool {
+					return IsRetryable(params.Err)
+				},
+				Logger: logger,
+			}
+
+			return retry.Middleware(h)(msg)
+		}
+	}
+}
+
+type PoisonQueue struct {
+	db        *sqlx.DB
+	publisher *watermillSQL.Publisher
+}
+
+func NewPoisonQueue(db *sqlx.DB, logger watermill.LoggerAdapter) (*PoisonQueue, error) {
+	pub, err := watermillSQL.NewPublisher(
+		watermillSQL.BeginnerFromStdSQL(db.DB),
+		watermillSQL.PublisherConfig{
+			SchemaAdapter: watermillSQL.DefaultPostgreSQLSchema{},
+		},
+		logger,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create poison queue publisher: %w", err)
+	}
+
+	return &PoisonQueue{
+		db:        db,
+		publisher: pub,
+	}, nil
+}
+
+// Middleware moves messages that failed all retries to the poison topic, with the
+// failure reason, handler name and original topic in metadata.
+func (p *PoisonQueue) Middleware() (message.HandlerMiddleware, error) {
+	return middleware.PoisonQueueWithFilter(p.publisher, poisonTopic, shouldPoison)
+}
+
+// shouldPoison keeps messages that failed while a gateway's circuit breaker is open out of the poison queue.
+// The breaker stays open much longer than the handler retries take, so these messages are nacked instead
+// and redelivered until the gateway is back.
+func shouldPoison(err error) bool {
+	return !errors.Is(err, ErrCircuitOpen)
+}
+
+type PoisonedMessage struct {
+	UUID          string            `json:"uuid"`
+	Reason        string            `json:"reason"`
+	OriginalTopic string            `json:"original_topic"`
+	Handler       string            `json:"handler"`
+	Payload       json.RawMessage   `json:"payload"`
+	Metadata      map[string]string `json:"metadata"`
+	PoisonedAt    time.Time         `json:"poisoned_at"`
+}
+
+type poisonedMessageRow struct {
+	UUID      string    `db:"uuid"`
+	Payload   []byte    `db:"payload"`
+	Metadata  []byte    `db:"metadata"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func (r poisonedMessageRow) toPoisonedMessage() (PoisonedMessage, error) {
+	metadata := map[string]string{}
+	if len(r.Metadata) > 0 {
+		if err := json.Unmarshal(r.Metadata, &metadata); err != nil {
+			return PoisonedMessage{}, fmt.Errorf("failed to unmarshal metadata of message %s: %w", r.UUID, err)
+		}
+	}
+
+	return PoisonedMessage{
+		UUID:          r.UUID,
+		Reason:        metadata[middleware.ReasonForPoisonedKey],
+		OriginalTopic: metadata[middleware.PoisonedTopicKey],
+		Handler:       metadata[middleware.PoisonedHandlerKey],
+		Payload:       r.Payload,
+		Metadata:      metadata,
+		PoisonedAt:    r.CreatedAt,
+	}, nil
+}
+
+func (p *PoisonQueue) List(ctx context.Context) ([]PoisonedMessage, error) {
+	var rows []poisonedMessageRow
+	err := p.db.SelectContext(ctx, &rows, `
+		SELECT uuid, payload, metadata, created_at
+		FROM "watermill_poison"
+		ORDER BY "offset"
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list poisoned messages: %w", err)
+	}
+
+	messages := make([]PoisonedMessage, 0, len(rows))
+	for _, row := range rows {
+		msg, err := row.toPoisonedMessage()
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+var ErrPoisonedMessageNotFound = errors.New("poisoned message not found")
+
+// Republish publishes a poisoned message back to its original topic and removes it from the poison queue.
+func (p *PoisonQueue) Republish(ctx context.Context, uuid string, pub message.Publisher) error {
+	return UpdateInTx(ctx, p.db, sql.LevelReadCommitted, func(ctx context.Context, tx *sqlx.Tx) error {
+		var row poisonedMessageRow
+		err := tx.GetContext(ctx, &row, `
+			SELECT uuid, payload, metadata, created_at
+			FROM "watermill_poison"
+			WHERE uuid = $1
+			ORDER BY "offset"
+			LIMIT 1
+			FOR UPDATE
+		`, uuid)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return ErrPoisonedMessageNotFound
+			}
+			return fmt.Errorf("failed to get poisoned message: %w", err)
+		}
+
+		poisoned, err := row.toPoisonedMessage()
+		if err != nil {
+			return err
+		}
+		if poisoned.OriginalTopic == "" {
+			return fmt.Errorf("poisoned message %s has no original topic", uuid)
+		}
+
+		msg := message.NewMessage(poisoned.UUID, message.Payload(poisoned.Payload))
+		for k, v := range poisoned.Metadata {
+			msg.Metadata.Set(k, v)
+		}
+		for _, k := range poisonMetadataKeys {
+			delete(msg.Metadata, k)
+		}
+
+		_, err = tx.ExecContext(ctx, `
+			DELETE FROM "watermill_poison"
+			WHERE uuid = $1
+		`, uuid)
+		if err != nil {
+			return fmt.Errorf("failed to delete poisoned message: %w", err)
+		}
+
+		// Published last, so a failed publish rolls back the delete and the message stays in the queue.
+		if err := pub.Publish(poisoned.OriginalTopic, msg); err != nil {
+			return fmt.Errorf("failed to republish message: %w", err)
+		}
+
+		return nil
+	})
+}
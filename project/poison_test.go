@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestPoisonQueue(t *testing.T) *PoisonQueue {
+	t.Helper()
+
+	poisonQueue, err := NewPoisonQueue(newTestDB(t), newWatermillLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return poisonQueue
+}
+
+// poisonTestMessage publishes a message to the poison queue, like the poison queue middleware does.
+func poisonTestMessage(t *testing.T, poisonQueue *PoisonQueue, originalTopic string) *message.Message {
+	t.Helper()
+
+	msg := message.NewMessage(watermill.NewUUID(), []byte(`{"user_id": "0190b6e4-7c4a-7d6b-9d4e-1f2a3b4c5d6e"}`))
+	msg.Metadata.Set("name", "UserRegistered")
+	msg.Metadata.Set(middleware.ReasonForPoisonedKey, "gateway rejected the request")
+	msg.Metadata.Set(middleware.PoisonedTopicKey, originalTopic)
+	msg.Metadata.Set(middleware.PoisonedHandlerKey, "AddToCRM")
+	msg.Metadata.Set(middleware.PoisonedSubscriberKey, "kafka")
+
+	if err := poisonQueue.publisher.Publish(poisonTopic, msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestAdminAPI_republishPoisonedMessage(t *testing.T) {
+	poisonQueue := newTestPoisonQueue(t)
+	poisoned := poisonTestMessage(t, poisonQueue, topic)
+
+	pubSub := gochannel.NewGoChannel(gochannel.Config{Persistent: true}, newWatermillLogger())
+	t.Cleanup(func() { pubSub.Close() })
+
+	config := DefaultConfig().HTTP
+	config.AdminToken = testAdminToken
+	router := NewHTTPRouter(config, poisonQueue.db, nil, poisonQueue, pubSub, prometheus.NewRegistry(), nil, nil, nil)
+
+	adminRequest := func(method string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := adminRequest(http.MethodGet, "/admin/poisoned-messages")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+
+	var listed []PoisonedMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 1 {
+		t.Fatalf("expected 1 poisoned message, got %d", len(listed))
+	}
+	if got := listed[0]; got.UUID != poisoned.UUID || got.OriginalTopic != topic || got.Handler != "AddToCRM" || got.Reason == "" {
+		t.Errorf("unexpected poisoned message: %+v", got)
+	}
+
+	republished, err := pubSub.Subscribe(context.Background(), topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec = adminRequest(http.MethodPost, "/admin/poisoned-messages/"+poisoned.UUID+"/republish")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+
+	select {
+	case msg := <-republished:
+		msg.Ack()
+
+		if msg.UUID != poisoned.UUID || string(msg.Payload) != string(poisoned.Payload) {
+			t.Errorf("expected the poisoned message, got %s: %s", msg.UUID, msg.Payload)
+		}
+		if msg.Metadata.Get("name") != "UserRegistered" {
+			t.Errorf("expected the original metadata to be kept, got %v", msg.Metadata)
+		}
+		for _, key := range poisonMetadataKeys {
+			if _, ok := msg.Metadata[key]; ok {
+				t.Errorf("expected metadata %s to be removed", key)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message wasn't republished to %s", topic)
+	}
+
+	remaining, err := poisonQueue.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("expected the poison queue to be empty, got %d messages", len(remaining))
+	}
+
+	// It's gone, so republishing it again doesn't publish a duplicate.
+	rec = adminRequest(http.MethodPost, "/admin/poisoned-messages/"+poisoned.UUID+"/republish")
+	assertProblem(t, rec.Code, rec.Header().Get("Content-Type"), rec.Body.Bytes(), http.StatusNotFound, "poisoned_message_not_found", nil)
+}
+
+// failingPublisher fails every publish, like a broker that's down.
+type failingPublisher struct{}
+
+func (failingPublisher) Publish(string, ...*message.Message) error { return errBrokerDown }
+func (failingPublisher) Close() error                              { return nil }
+
+var errBrokerDown = errors.New("broker is down")
+
+func TestPoisonQueue_Republish_publishFailed(t *testing.T) {
+	poisonQueue := newTestPoisonQueue(t)
+	poisoned := poisonTestMessage(t, poisonQueue, topic)
+
+	if err := poisonQueue.Republish(context.Background(), poisoned.UUID, failingPublisher{}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// The delete is rolled back, so the message can be republished later.
+	remaining, err := poisonQueue.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0].UUID != poisoned.UUID {
+		t.Errorf("expected the message to stay in the poison queue, got %+v", remaining)
+	}
+}
+
+func TestPoisonQueue_Middleware(t *testing.T) {
+	testCases := []struct {
+		name         string
+		err          error
+		wantPoisoned bool
+	}{
+		{
+			name:         "permanent_error",
+			err:          &GatewayError{Gateway: "crm", StatusCode: http.StatusBadRequest, Err: errors.New("bad request")},
+			wantPoisoned: true,
+		},
+		{
+			// Nacked and redelivered until the gateway is back.
+			name:         "circuit_open",
+			err:          fmt.Errorf("failed to send user to CRM: %w", &GatewayError{Gateway: "crm", Retryable: true, Err: ErrCircuitOpen}),
+			wantPoisoned: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			poisonQueue := newTestPoisonQueue(t)
+
+			poisonMiddleware, err := poisonQueue.Middleware()
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := poisonMiddleware(func(msg *message.Message) ([]*message.Message, error) {
+				return nil, tc.err
+			})
+
+			msg := message.NewMessage(watermill.NewUUID(), []byte(`{}`))
+			_, err = handler(msg)
+
+			// A poisoned message is acked, so the handler doesn't fail.
+			if (err == nil) != tc.wantPoisoned {
+				t.Errorf("expected poisoned %v, got handler error %v", tc.wantPoisoned, err)
+			}
+
+			poisoned, err := poisonQueue.List(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantPoisoned {
+				if len(poisoned) != 1 || poisoned[0].UUID != msg.UUID || poisoned[0].Reason != tc.err.Error() {
+					t.Errorf("expected the message to be poisoned with the reason, got %+v", poisoned)
+				}
+			} else if len(poisoned) != 0 {
+				t.Errorf("expected no poisoned messages, got %+v", poisoned)
+			}
+		})
+	}
+}
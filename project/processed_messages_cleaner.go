@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var processedMessagesCleanedRowsTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "processed_messages",
+		Name:      "cleaned_rows_total",
+		Help:      "Processed message markers deleted after the retention.",
+	},
+)
+
+// ProcessedMessagesCleaner deletes processed message markers once they are older than the retention,
+// so the processed_messages table doesn't grow with every handled message.
+type ProcessedMessagesCleaner struct {
+	db     *sqlx.DB
+	config ProcessedMessagesConfig
+}
+
+func NewProcessedMessagesCleaner(db *sqlx.DB, config ProcessedMessagesConfig) *ProcessedMessagesCleaner {
+	return &ProcessedMessagesCleaner{
+		db:     db,
+		config: config,
+	}
+}
+
+func (c *ProcessedMessagesCleaner) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.config.CleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := c.Clean(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.With("error", err).Error("Failed to clean processed messages")
+		}
+		if removed > 0 {
+			slog.Info("Cleaned processed messages", "removed_rows", removed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Clean deletes all markers older than the retention, one batch at a time,
+// and returns the number of rows deleted.
+func (c *ProcessedMessagesCleaner) Clean(ctx context.Context) (int64, error) {
+	var total int64
+
+	for {
+		res, err := c.db.ExecContext(ctx, `
+			DELETE FROM processed_messages
+			WHERE (handler_name, message_uuid) IN (
+				SELECT handler_name, message_uuid
+				FROM processed_messages
+				WHERE processed_at < now() - make_interval(secs => $1)
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED
+			)
+		`, c.config.Retention.Seconds(), c.config.BatchSize)
+		if err != nil {
+			return total, fmt.Errorf("failed to clean processed messages batch: %w", err)
+		}
+
+		removed, err := res.RowsAffected()
+		if err != nil {
+			return total, fmt.Errorf("failed to get rows affected: %w", err)
+		}
+		total += removed
+		processedMessagesCleanedRowsTotal.Add(float64(removed))
+
+		if removed < int64(c.config.BatchSize) {
+			return total, nil
+		}
+	}
+}
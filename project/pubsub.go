@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	watermillSQL "github.com/ThreeDotsLabs/watermill-sql/v4/pkg/sql"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
+	"github.com/jmoiron/sqlx"
+)
+
+// PubSubBackend selects the broker used between the forwarder, the splitter and the event handlers.
+type PubSubBackend string
+
+const (
+	PubSubBackendKafka     PubSubBackend = "kafka"
+	PubSubBackendGoChannel PubSubBackend = "gochannel"
+	PubSubBackendSQL       PubSubBackend = "sql"
+)
+
+// PubSub hands out publishers and subscribers for a single backend,
+// so all components of the service talk to the same broker.
+type PubSub struct {
+	backend       PubSubBackend
+	groupPrefix   string
+	publisher     message.Publisher
+	newSubscriber func(consumerGroup string) (message.Subscriber, error)
+	ping          func(ctx context.Context) error
+	seek          func(consumerGroup string, topic string, start ConsumerGroupStart) error
+}
+
+func NewPubSub(config PubSubConfig, db *sqlx.DB, logger watermill.LoggerAdapter) (*PubSub, error) {
+	switch config.Backend {
+	case PubSubBackendKafka:
+		brokers := config.KafkaBrokers
+
+		pub, err := kafka.NewPublisher(kafka.PublisherConfig{
+			Brokers:   brokers,
+			Marshaler: KafkaMarshaler,
+		}, logger)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create kafka publisher: %w", err)
+		}
+
+		return &PubSub{
+			backend:     PubSubBackendKafka,
+			groupPrefix: config.ConsumerGroupPrefix,
+			publisher:   pub,
+			newSubscriber: func(consumerGroup string) (message.Subscriber, error) {
+				return kafka.NewSubscriber(kafka.SubscriberConfig{
+					OverwriteSaramaConfig: newSubscriberSaramaConfig(),
+					Brokers:               brokers,
+					Unmarshaler:           KafkaMarshaler,
+					ConsumerGroup:         consumerGroup,
+				}, logger)
+			},
+			ping: func(ctx context.Context) error {
+				return pingKafka(brokers)
+			},
+		}, nil
+	case PubSubBackendGoChannel:
+		// GoChannel delivers every message to every subscriber of a topic,
+		// which matches Kafka's behaviour of one consumer group per handler.
+		// It's persistent, so like with Kafka a subscriber gets the messages published before it subscribed,
+		// at the cost of keeping all of them in memory. It's meant for local development and tests.
+		goChannel := gochannel.NewGoChannel(gochannel.Config{Persistent: true}, logger)
+
+		return &PubSub{
+			backend:     PubSubBackendGoChannel,
+			groupPrefix: config.ConsumerGroupPrefix,
+			publisher:   goChannel,
+			newSubscriber: func(consumerGroup string) (message.Subscriber, error) {
+				return goChannel, nil
+			},
+		}, nil
+	case PubSubBackendSQL:
+		if db == nil {
+			return nil, fmt.Errorf("sql pub/sub backend requires a database")
+		}
+
+		pub, err := watermillSQL.NewPublisher(
+			watermillSQL.BeginnerFromStdSQL(db.DB),
+			watermillSQL.PublisherConfig{
+				SchemaAdapter:        watermillSQL.DefaultPostgreSQLSchema{},
+				AutoInitializeSchema: true,
+			},
+			logger,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create sql publisher: %w", err)
+		}
+
+		return &PubSub{
+			backend:     PubSubBackendSQL,
+			groupPrefix: config.ConsumerGroupPrefix,
+			publisher:   pub,
+			newSubscriber: func(consumerGroup string) (message.Subscriber, error) {
+				return watermillSQL.NewSubscriber(
+					watermillSQL.BeginnerFromStdSQL(db.DB),
+					watermillSQL.SubscriberConfig{
+						ConsumerGroup:    consumerGroup,
+						InitializeSchema: true,
+						SchemaAdapter:    watermillSQL.DefaultPostgreSQLSchema{},
+						OffsetsAdapter:   watermillSQL.DefaultPostgreSQLOffsetsAdapter{},
+					},
+					logger,
+				)
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown pub/sub backend: %q", config.Backend)
+	}
+}
+
+func (p *PubSub) Backend() PubSubBackend {
+	return p.backend
+}
+
+func (p *PubSub) Publisher() message.Publisher {
+	return p.publisher
+}
+
+// Subscriber creates a subscriber for the consumer group, with the configured prefix.
+func (p *PubSub) Subscriber(consumerGroup string) (message.Subscriber, error) {
+	return p.newSubscriber(p.groupPrefix + consumerGroup)
+}
+
+// Ping checks the connection to the broker. Backends without a separate broker always succeed.
+func (p *PubSub) Ping(ctx context.Context) error {
+	if p.ping == nil {
+		return nil
+	}
+	return p.ping(ctx)
+}
+
+// ConsumerGroupStart is where a new consumer group starts consuming a topic.
+type ConsumerGroupStart struct {
+	// Offsets is the first offset to consume, by partition.
+	Offsets map[int32]int64
+
+	// Partitions without an offset start at the first message published at or after Time,
+	// or at the oldest message when Time is zero.
+	Time time.Time
+}
+
+func (s ConsumerGroupStart) IsZero() bool {
+	return len(s.Offsets) == 0 && s.Time.IsZero()
+}
+
+// SeekConsumerGroup sets where a consumer group that didn't consume the topic yet starts,
+// so messages before the start aren't delivered at all. It's only supported with Kafka.
+func (p *PubSub) SeekConsumerGroup(consumerGroup string, topic string, start ConsumerGroupStart) error {
+	if p.seek == nil {
+		return fmt.Errorf("seeking a consumer group isn't supported by the %s pub/sub backend", p.backend)
+	}
+	return p.seek(p.groupPrefix+consumerGroup, topic, start)
+}
+
+// seekKafkaConsumerGroup commits the start offsets for the consumer group, which it then consumes from
+// instead of the initial offset.
+func seekKafkaConsumerGroup(brokers []string, consumerGroup string, topic string, start ConsumerGroupStart) error {
+	cfg := newSubscriberSaramaConfig()
+	// Failed commits are only reported on the partition offset managers' error channels.
+	cfg.Consumer.Return.Errors = true
+
+	client, err := sarama.NewClient(brokers, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to connect to kafka: %w", err)
+	}
+	defer client.Close()
+
+	partitions, err := client.Partitions(topic)
+	if err != nil {
+		return fmt.Errorf("failed to get partitions of %s: %w", topic, err)
+	}
+	for partition := range start.Offsets {
+		if !slices.Contains(partitions, partition) {
+			return fmt.Errorf("topic %s has no partition %d", topic, partition)
+		}
+	}
+
+	offsetManager, err := sarama.NewOffsetManagerFromClient(consumerGroup, client)
+	if err != nil {
+		return fmt.Errorf("failed to create offset manager: %w", err)
+	}
+	defer offsetManager.Close()
+
+	var partitionManagers []sarama.PartitionOffsetManager
+	for _, partition := range partitions {
+		offset, ok := start.Offsets[partition]
+		if !ok && start.Time.IsZero() {
+			continue
+		}
+		if !ok {
+			offset, err = client.GetOffset(topic, partition, start.Time.UnixMilli())
+			if err != nil {
+				return fmt.Errorf("failed to get offset of partition %d at %s: %w", partition, start.Time, err)
+			}
+			// Nothing was published since Time, so only new messages are consumed.
+			if offset == sarama.OffsetNewest {
+				offset, err = client.GetOffset(topic, partition, sarama.OffsetNewest)
+				if err != nil {
+					return fmt.Errorf("failed to get newest offset of partition %d: %w", partition, err)
+				}
+			}
+		}
+
+		partitionManager, err := offsetManager.ManagePartition(topic, partition)
+		if err != nil {
+			return fmt.Errorf("failed to manage offset of partition %d: %w", partition, err)
+		}
+		partitionManager.ResetOffset(offset, "")
+		partitionManagers = append(partitionManagers, partitionManager)
+	}
+
+	offsetManager.Commit()
+
+	var errs []error
+	for _, partitionManager := range partitionManagers {
+		if err := partitionManager.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to commit start offsets: %w", err)
+	}
+
+	return nil
+}
+
+func pingKafka(brokers []string) error {
+	cfg := sarama.NewConfig()
+	cfg.Net.DialTimeout = healthCheckTimeout
+	cfg.Metadata.Retry.Max = 0
+	cfg.Metadata.Full = false
+
+	client, err := sarama.NewClient(brokers, cfg)
+	if err != nil {
+		return fmt.Errorf("failed to connect to kafka: %w", err)
+	}
+	defer client.Close()
+
+	// Without Metadata.Full, NewClient doesn't contact the brokers, so the metadata is fetched here.
+	if err := client.RefreshMetadata(); err != nil {
+		return fmt.Errorf("failed to get kafka metadata: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+type ReplayConfig struct {
+	// Handler is the name of the event handler to run, like AddToCRM.
+	Handler string
+
+	// From is where the replay starts in the topic, from the oldest message when it's zero.
+	// The consumer group is moved there before subscribing, which is only supported with Kafka.
+	From ConsumerGroupStart
+
+	// DryRun only logs the events that would be handled.
+	DryRun bool
+
+	// Rate limits handled events per second. Zero means no limit.
+	Rate float64
+
+	// The replay fails if no message arrives within StartTimeout, for example while a Kafka consumer
+	// group rebalance takes longer. After the first message, it finishes when no message arrives for IdleTimeout.
+	StartTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// Flush runs after the last event is handled, unless it's a dry run. It sends what
+	// the handlers only queued, like users queued for the CRM while batching is enabled.
+	Flush func(ctx context.Context) error
+}
+
+type ReplayStats struct {
+	Handled int
+}
+
+// Replay consumes the topic of one event handler with a fresh consumer group, so it starts
+// from the oldest message or from config.From, and runs the handler for each event.
+//
+// Messages are passed to the handler directly, without the processed-messages check,
+// so side effects of events that were already handled are run again.
+func Replay(ctx context.Context, pubSub *PubSub, handlers []cqrs.EventHandler, config ReplayConfig) (ReplayStats, error) {
+	var stats ReplayStats
+
+	handler, err := findEventHandler(handlers, config.Handler)
+	if err != nil {
+		return stats, err
+	}
+
+	eventName := CQRSMarshaler.Name(handler.NewEvent())
+	consumerGroup := fmt.Sprintf("replay-%s-%d", handler.HandlerName(), time.Now().Unix())
+
+	logger := slog.With(
+		"handler", handler.HandlerName(),
+		"topic", eventName,
+		"consumer_group", consumerGroup,
+		"dry_run", config.DryRun,
+	)
+	logger.Info("Starting replay")
+
+	if !config.From.IsZero() {
+		if err := pubSub.SeekConsumerGroup(consumerGroup, eventName, config.From); err != nil {
+			return stats, fmt.Errorf("failed to seek consumer group: %w", err)
+		}
+	}
+
+	sub, err := pubSub.Subscriber(consumerGroup)
+	if err != nil {
+		return stats, fmt.Errorf("failed to create subscriber: %w", err)
+	}
+	defer sub.Close()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	messages, err := sub.Subscribe(ctx, eventName)
+	if err != nil {
+		return stats, fmt.Errorf("failed to subscribe to %s: %w", eventName, err)
+	}
+
+	var throttle <-chan time.Time
+	if config.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / config.Rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	// The idle timeout only starts with the first message, so the time it takes to join
+	// the consumer group isn't mistaken for the end of the topic.
+	idle := time.NewTimer(config.StartTimeout)
+	defer idle.Stop()
+	received := false
+
+	for {
+		var msg *message.Message
+		select {
+		case <-ctx.Done():
+			return stats, ctx.Err()
+		case <-idle.C:
+			if !received {
+				return stats, fmt.Errorf("no message received within %s, the topic may be empty", config.StartTimeout)
+			}
+			if config.Flush != nil && !config.DryRun {
+				if err := config.Flush(ctx); err != nil {
+					return stats, fmt.Errorf("failed to flush after replay: %w", err)
+				}
+			}
+			logger.Info("Replay finished", "handled", stats.Handled)
+			return stats, nil
+		case m, ok := <-messages:
+			if !ok {
+				return stats, errors.New("subscriber closed during replay")
+			}
+			msg = m
+			received = true
+		}
+
+		if config.DryRun {
+			logger.Info("Would replay event", "message_uuid", msg.UUID)
+			stats.Handled++
+			msg.Ack()
+			idle.Reset(config.IdleTimeout)
+			continue
+		}
+
+		if throttle != nil {
+			select {
+			case <-ctx.Done():
+				msg.Nack()
+				return stats, ctx.Err()
+			case <-throttle:
+			}
+		}
+
+		if err := replayMessage(msg, handler); err != nil {
+			msg.Nack()
+			return stats, fmt.Errorf("failed to replay message %s: %w", msg.UUID, err)
+		}
+
+		logger.Debug("Replayed event", "message_uuid", msg.UUID)
+		stats.Handled++
+		msg.Ack()
+		idle.Reset(config.IdleTimeout)
+	}
+}
+
+func findEventHandler(handlers []cqrs.EventHandler, name string) (cqrs.EventHandler, error) {
+	for _, h := range handlers {
+		if h.HandlerName() == name {
+			return h, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown event handler: %q", name)
+}
+
+func replayMessage(msg *message.Message, handler cqrs.EventHandler) error {
+	ctx := extractTraceContext(msg.Context(), msg)
+	if correlationID := msg.Metadata.Get(CorrelationIDMetadataKey); correlationID != "" {
+		ctx = ContextWithCorrelationID(ctx, correlationID)
+	}
+
+	event := handler.NewEvent()
+	if err := CQRSMarshaler.Unmarshal(msg, event); err != nil {
+		return err
+	}
+
+	return handler.Handle(ctx, event)
+}
+
+// parsePartitionOffsets parses a comma-separated list of partition:offset pairs, like 0:120,1:98.
+func parsePartitionOffsets(value string) (map[int32]int64, error) {
+	offsets := map[int32]int64{}
+
+	for pair := range strings.SplitSeq(value, ",") {
+		partition, offset, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("expected partition:offset, got %q", pair)
+		}
+
+		p, err := strconv.ParseInt(partition, 10, 32)
+		if err != nil || p < 0 {
+			return nil, fmt.Errorf("invalid partition %q", partition)
+		}
+		o, err := strconv.ParseInt(offset, 10, 64)
+		if err != nil || o < 0 {
+			return nil, fmt.Errorf("invalid offset %q", offset)
+		}
+		if _, ok := offsets[int32(p)]; ok {
+			return nil, fmt.Errorf("partition %d is set more than once", p)
+		}
+
+		offsets[int32(p)] = o
+	}
+
+	return offsets, nil
+}
+
+func runReplayCommand(ctx context.Context, pubSub *PubSub, handlers []cqrs.EventHandler, crm *CRMBatcher, args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+
+	config := ReplayConfig{}
+	flags.StringVar(&config.Handler, "handler", "", "name of the event handler to replay, like AddToCRM")
+	fromOffsets := flags.String("from-offset", "", "start each listed Kafka partition at its offset, like 0:120,1:98")
+	fromTime := flags.String("from-time", "", "start the other Kafka partitions at the first message published at or after this time (RFC 3339)")
+	flags.BoolVar(&config.DryRun, "dry-run", false, "only log the events that would be handled")
+	flags.Float64Var(&config.Rate, "rate", 0, "maximum handled events per second, 0 for no limit")
+	flags.DurationVar(&config.StartTimeout, "start-timeout", time.Minute, "fail when the first message doesn't arrive within this time")
+	flags.DurationVar(&config.IdleTimeout, "idle-timeout", 10*time.Second, "finish when no message arrives for this long after the first one")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if config.Handler == "" {
+		return errors.New("usage: replay -handler NAME [-from-offset PARTITION:OFFSET,...] [-from-time TIME] [-dry-run] [-rate N] [-start-timeout D] [-idle-timeout D]")
+	}
+	if *fromOffsets != "" {
+		var err error
+		config.From.Offsets, err = parsePartitionOffsets(*fromOffsets)
+		if err != nil {
+			return fmt.Errorf("invalid -from-offset: %w", err)
+		}
+	}
+	if *fromTime != "" {
+		var err error
+		config.From.Time, err = time.Parse(time.RFC3339, *fromTime)
+		if err != nil {
+			return fmt.Errorf("invalid -from-time: %w", err)
+		}
+	}
+	if config.Rate < 0 {
+		return fmt.Errorf("invalid -rate: %v", config.Rate)
+	}
+	if config.StartTimeout <= 0 {
+		return fmt.Errorf("invalid -start-timeout: %v", config.StartTimeout)
+	}
+	if config.IdleTimeout <= 0 {
+		return fmt.Errorf("invalid -idle-timeout: %v", config.IdleTimeout)
+	}
+
+	// With batching enabled, AddToCRM only queues users, so they're sent before the command exits.
+	config.Flush = func(ctx context.Context) error {
+		sent, err := crm.Flush(ctx)
+		if sent > 0 {
+			slog.Info("Sent queued users to CRM", "users", sent)
+		}
+		return err
+	}
+
+	_, err := Replay(ctx, pubSub, handlers, config)
+	return err
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/gofrs/uuid/v5"
+)
+
+func newTestGoChannelPubSub(t *testing.T) *PubSub {
+	t.Helper()
+
+	pubSub, err := NewPubSub(PubSubConfig{Backend: PubSubBackendGoChannel}, nil, newWatermillLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pubSub
+}
+
+// publishUserRegistered doesn't stop the test on errors, so it can be called from other goroutines.
+func publishUserRegistered(t *testing.T, pubSub *PubSub, users ...string) {
+	t.Helper()
+
+	for _, name := range users {
+		msg, err := CQRSMarshaler.Marshal(&UserRegistered{
+			UserID: uuid.Must(uuid.NewV7()),
+			Name:   name,
+			Email:  strings.ToLower(name) + "@example.com",
+		})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := pubSub.Publisher().Publish("UserRegistered", msg); err != nil {
+			t.Error(err)
+			return
+		}
+	}
+}
+
+// replayedUsers is an event handler that records the names of the users it handled.
+type replayedUsers struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (r *replayedUsers) Handlers() []cqrs.EventHandler {
+	return []cqrs.EventHandler{
+		cqrs.NewEventHandler("RecordUser", func(ctx context.Context, event *UserRegistered) error {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			r.names = append(r.names, event.Name)
+			return nil
+		}),
+	}
+}
+
+func (r *replayedUsers) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.names...)
+}
+
+func TestReplay(t *testing.T) {
+	pubSub := newTestGoChannelPubSub(t)
+	publishUserRegistered(t, pubSub, "Alice", "Bob", "Carol")
+
+	handled := &replayedUsers{}
+	stats, err := Replay(context.Background(), pubSub, handled.Handlers(), ReplayConfig{
+		Handler:      "RecordUser",
+		StartTimeout: time.Second,
+		IdleTimeout:  200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Handled != 3 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	names := handled.Names()
+	slices.Sort(names)
+	if !slices.Equal(names, []string{"Alice", "Bob", "Carol"}) {
+		t.Errorf("expected all users to be replayed, got %v", names)
+	}
+}
+
+func TestReplay_dryRun(t *testing.T) {
+	pubSub := newTestGoChannelPubSub(t)
+	publishUserRegistered(t, pubSub, "Alice", "Bob")
+
+	handled := &replayedUsers{}
+	stats, err := Replay(context.Background(), pubSub, handled.Handlers(), ReplayConfig{
+		Handler:      "RecordUser",
+		DryRun:       true,
+		StartTimeout: time.Second,
+		IdleTimeout:  200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Handled != 2 {
+		t.Errorf("expected 2 events in the dry run, got %+v", stats)
+	}
+	if names := handled.Names(); len(names) != 0 {
+		t.Errorf("dry run ran the handler for %v", names)
+	}
+}
+
+func TestReplay_idleTimeoutStartsWithFirstMessage(t *testing.T) {
+	pubSub := newTestGoChannelPubSub(t)
+
+	// The first message arrives after the idle timeout, like after a slow consumer group rebalance.
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		publishUserRegistered(t, pubSub, "Alice")
+	}()
+
+	handled := &replayedUsers{}
+	stats, err := Replay(context.Background(), pubSub, handled.Handlers(), ReplayConfig{
+		Handler:      "RecordUser",
+		StartTimeout: 5 * time.Second,
+		IdleTimeout:  100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Handled != 1 {
+		t.Errorf("expected the late message to be replayed, got %+v", stats)
+	}
+}
+
+func TestReplay_noMessages(t *testing.T) {
+	pubSub := newTestGoChannelPubSub(t)
+
+	handled := &replayedUsers{}
+	_, err := Replay(context.Background(), pubSub, handled.Handlers(), ReplayConfig{
+		Handler:      "RecordUser",
+		StartTimeout: 100 * time.Millisecond,
+		IdleTimeout:  100 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("expected an error when no message arrives")
+	}
+}
+
+func TestReplay_unknownHandler(t *testing.T) {
+	pubSub := newTestGoChannelPubSub(t)
+
+	_, err := Replay(context.Background(), pubSub, (&replayedUsers{}).Handlers(), ReplayConfig{
+		Handler:      "Unknown",
+		StartTimeout: 100 * time.Millisecond,
+		IdleTimeout:  100 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("expected an error for an unknown handler")
+	}
+}
+
+func TestReplay_flush(t *testing.T) {
+	testCases := []struct {
+		name        string
+		dryRun      bool
+		wantFlushed bool
+	}{
+		{name: "replay", wantFlushed: true},
+		{name: "dry_run", dryRun: true, wantFlushed: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pubSub := newTestGoChannelPubSub(t)
+			publishUserRegistered(t, pubSub, "Alice")
+
+			handled := &replayedUsers{}
+			flushed := 0
+			_, err := Replay(context.Background(), pubSub, handled.Handlers(), ReplayConfig{
+				Handler:      "RecordUser",
+				DryRun:       tc.dryRun,
+				StartTimeout: time.Second,
+				IdleTimeout:  100 * time.Millisecond,
+				Flush: func(ctx context.Context) error {
+					// The events are handled before the flush.
+					if !tc.dryRun && len(handled.Names()) != 1 {
+						t.Errorf("flushed before the event was handled")
+					}
+					flushed++
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (flushed == 1) != tc.wantFlushed || flushed > 1 {
+				t.Errorf("expected flushed %v, got %d flushes", tc.wantFlushed, flushed)
+			}
+		})
+	}
+}
+
+// Only Kafka consumer groups can be moved to an offset or time, other backends fail instead of replaying everything.
+func TestReplay_fromNotSupported(t *testing.T) {
+	pubSub := newTestGoChannelPubSub(t)
+	publishUserRegistered(t, pubSub, "Alice")
+
+	handled := &replayedUsers{}
+	_, err := Replay(context.Background(), pubSub, handled.Handlers(), ReplayConfig{
+		Handler:      "RecordUser",
+		From:         ConsumerGroupStart{Offsets: map[int32]int64{0: 1}},
+		StartTimeout: time.Second,
+		IdleTimeout:  100 * time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if names := handled.Names(); len(names) != 0 {
+		t.Errorf("expected nothing to be replayed, got %v", names)
+	}
+}
+
+func TestParsePartitionOffsets(t *testing.T) {
+	testCases := []struct {
+		value   string
+		want    map[int32]int64
+		wantErr bool
+	}{
+		{value: "0:120", want: map[int32]int64{0: 120}},
+		{value: "0:120,1:98,3:0", want: map[int32]int64{0: 120, 1: 98, 3: 0}},
+		{value: "120", wantErr: true},
+		{value: "0:120,", wantErr: true},
+		{value: "a:120", wantErr: true},
+		{value: "0:b", wantErr: true},
+		{value: "-1:120", wantErr: true},
+		{value: "0:-5", wantErr: true},
+		{value: "0:1,0:2", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			got, err := parsePartitionOffsets(tc.value)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// SchemaVersionMetadataKey holds the schema version an event payload was marshaled with.
+// Messages without it were published before versioning and are version 1.
+const SchemaVersionMetadataKey = "schema_version"
+
+// Upcaster turns a JSON payload of one schema version into the next version.
+type Upcaster func(payload map[string]any) error
+
+// EventSchema is the current schema version of an event, with upcasters for the older versions.
+// Upcasters[v] turns version v into v+1, so a message of any older version is upcast step by step.
+// A breaking change to an event struct bumps Version and adds the upcaster from the previous version.
+type EventSchema struct {
+	Version   int
+	Upcasters map[int]Upcaster
+}
+
+// eventSchemas must have an entry for every published event, by its cqrs.StructName.
+var eventSchemas = map[string]EventSchema{
+	// Locale was added to v1 without a new version, events without it are rendered in DefaultLocale.
+	"UserRegistered": {
+		Version: 1,
+	},
+	"UserEmailChangeRequested": {
+		Version: 1,
+	},
+	// Not published anymore, kept for messages published before email changes were confirmed.
+	"UserEmailUpdated": {
+		Version: 1,
+	},
+	"UserEmailConfirmed": {
+		Version: 1,
+	},
+	"UserEmailChangeExpired": {
+		Version: 1,
+	},
+}
+
+// versionedMarshaler sets the schema version on marshaled events,
+// and upcasts payloads of older versions before they are unmarshaled.
+type versionedMarshaler struct {
+	cqrs.CommandEventMarshaler
+}
+
+func (m versionedMarshaler) Marshal(v any) (*message.Message, error) {
+	name := m.Name(v)
+
+	schema, ok := eventSchemas[name]
+	if !ok {
+		return nil, fmt.Errorf("no schema registered for event %s", name)
+	}
+
+	msg, err := m.CommandEventMarshaler.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	msg.Metadata.Set(SchemaVersionMetadataKey, strconv.Itoa(schema.Version))
+
+	return msg, nil
+}
+
+func (m versionedMarshaler) Unmarshal(msg *message.Message, v any) error {
+	payload, err := upcastEvent(m.NameFromMessage(msg), msg)
+	if err != nil {
+		return err
+	}
+
+	upcasted := msg.Copy()
+	upcasted.Payload = payload
+
+	return m.CommandEventMarshaler.Unmarshal(upcasted, v)
+}
+
+func upcastEvent(name string, msg *message.Message) ([]byte, error) {
+	schema, ok := eventSchemas[name]
+	if !ok {
+		return nil, fmt.Errorf("no schema registered for event %s", name)
+	}
+
+	version := 1
+	if v := msg.Metadata.Get(SchemaVersionMetadataKey); v != "" {
+		var err error
+		version, err = strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schema version %q of event %s: %w", v, name, err)
+		}
+	}
+
+	if version > schema.Version {
+		return nil, fmt.Errorf("event %s has schema version %d, newer than the supported %d", name, version, schema.Version)
+	}
+	if version == schema.Version {
+		return msg.Payload, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(msg.Payload))
+	decoder.UseNumber()
+
+	var payload map[string]any
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, fmt.Errorf("failed to decode event %s for upcasting: %w", name, err)
+	}
+
+	for ; version < schema.Version; version++ {
+		upcaster, ok := schema.Upcasters[version]
+		if !ok {
+			return nil, fmt.Errorf("no upcaster for event %s from schema version %d", name, version)
+		}
+		if err := upcaster(payload); err != nil {
+			return nil, fmt.Errorf("failed to upcast event %s from schema version %d: %w", name, version, err)
+		}
+	}
+
+	upcasted, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode upcasted event %s: %w", name, err)
+	}
+
+	return upcasted, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/gofrs/uuid/v5"
+)
+
+// TestEventFixtures_v1 runs the handlers over v1 payloads stored in testdata/events/v1, like messages
+// published by older versions of the service. There must be a fixture for every event in eventSchemas.
+func TestEventFixtures_v1(t *testing.T) {
+	userID := uuid.Must(uuid.FromString("0190b6e4-7c4a-7d6b-9d4e-1f2a3b4c5d6e"))
+
+	type expectedEmail struct {
+		to       string
+		subject  string
+		contains string
+	}
+
+	testCases := map[string]struct {
+		emails   []expectedEmail
+		crmUsers []uuid.UUID
+	}{
+		"UserRegistered": {
+			// Users registered before they had a locale get emails in the default one.
+			emails:   []expectedEmail{{to: "jane@example.com", subject: "Welcome to our website!", contains: "Hello Jane Doe"}},
+			crmUsers: []uuid.UUID{userID},
+		},
+		"UserEmailUpdated": {
+			emails: []expectedEmail{{to: "jane@example.com", subject: "Your email is updated", contains: "jane.new@example.com"}},
+		},
+		"UserEmailChangeRequested": {
+			emails: []expectedEmail{{to: "jane.new@example.com", subject: "Potwierdź swój nowy adres email", contains: "/email/confirm?token="}},
+		},
+		"UserEmailConfirmed": {
+			emails: []expectedEmail{{to: "jane@example.com", subject: "Your email is updated", contains: "jane.new@example.com"}},
+		},
+		"UserEmailChangeExpired": {},
+	}
+
+	for name := range eventSchemas {
+		if _, ok := testCases[name]; !ok {
+			t.Errorf("no test case for event %s", name)
+		}
+	}
+
+	// Messages published before versioning have no schema version, later v1 messages have it set.
+	versions := []string{"", "1"}
+
+	for name, tc := range testCases {
+		for _, version := range versions {
+			t.Run(name+"/schema_version="+version, func(t *testing.T) {
+				payload, err := os.ReadFile(filepath.Join("testdata", "events", "v1", name+".json"))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				msg := message.NewMessage(watermill.NewUUID(), payload)
+				msg.Metadata.Set("name", name)
+				if version != "" {
+					msg.Metadata.Set(SchemaVersionMetadataKey, version)
+				}
+
+				gateway := newFakeGateway(t)
+				handlers := newTestWatermillHandlers(t, gateway.URL)
+
+				for _, handler := range handlers.EventHandlers() {
+					event := handler.NewEvent()
+					if CQRSMarshaler.Name(event) != name {
+						continue
+					}
+
+					if err := CQRSMarshaler.Unmarshal(msg, event); err != nil {
+						t.Fatalf("failed to unmarshal %s: %v", name, err)
+					}
+					if err := handler.Handle(context.Background(), event); err != nil {
+						t.Fatalf("handler %s failed: %v", handler.HandlerName(), err)
+					}
+				}
+
+				for _, expected := range tc.emails {
+					emails := gateway.Emails(expected.to, expected.subject)
+					if len(emails) != 1 {
+						t.Errorf("expected 1 email %q to %s, got %d", expected.subject, expected.to, len(emails))
+						continue
+					}
+					if !strings.Contains(emails[0].Body, expected.contains) {
+						t.Errorf("email %q doesn't contain %q: %q", expected.subject, expected.contains, emails[0].Body)
+					}
+				}
+				if n := gateway.EmailCount(); n != len(tc.emails) {
+					t.Errorf("expected %d emails, got %d", len(tc.emails), n)
+				}
+
+				for _, userID := range tc.crmUsers {
+					if n := len(gateway.CRMUsers(userID)); n != 1 {
+						t.Errorf("expected user %s to be added to the CRM once, got %d", userID, n)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestCQRSMarshaler_Unmarshal_upcast(t *testing.T) {
+	schema := eventSchemas["UserRegistered"]
+	t.Cleanup(func() {
+		eventSchemas["UserRegistered"] = schema
+	})
+
+	// A made-up breaking change, the name was split into two fields and joined again in v3.
+	eventSchemas["UserRegistered"] = EventSchema{
+		Version: 3,
+		Upcasters: map[int]Upcaster{
+			1: func(payload map[string]any) error {
+				first, last, _ := strings.Cut(payload["name"].(string), " ")
+				payload["first_name"], payload["last_name"] = first, last
+				delete(payload, "name")
+				return nil
+			},
+			2: func(payload map[string]any) error {
+				payload["name"] = payload["last_name"].(string) + ", " + payload["first_name"].(string)
+				return nil
+			},
+		},
+	}
+
+	payload, err := os.ReadFile(filepath.Join("testdata", "events", "v1", "UserRegistered.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := message.NewMessage(watermill.NewUUID(), payload)
+	msg.Metadata.Set("name", "UserRegistered")
+
+	var event UserRegistered
+	if err := CQRSMarshaler.Unmarshal(msg, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Name != "Doe, Jane" {
+		t.Errorf("expected the name to be upcast to %q, got %q", "Doe, Jane", event.Name)
+	}
+	if event.Email != "jane@example.com" {
+		t.Errorf("expected the other fields to be kept, got email %q", event.Email)
+	}
+	if string(msg.Payload) != string(payload) {
+		t.Error("the payload of the original message was modified")
+	}
+}
+
+func TestCQRSMarshaler_Unmarshal_newerVersion(t *testing.T) {
+	msg := message.NewMessage(watermill.NewUUID(), []byte(`{"name": "Jane Doe"}`))
+	msg.Metadata.Set("name", "UserRegistered")
+	msg.Metadata.Set(SchemaVersionMetadataKey, "2")
+
+	var event UserRegistered
+	err := CQRSMarshaler.Unmarshal(msg, &event)
+	if err == nil || !strings.Contains(err.Error(), "newer than the supported") {
+		t.Errorf("expected an error about the newer version, got %v", err)
+	}
+}
+
+func TestCQRSMarshaler_Marshal_version(t *testing.T) {
+	msg, err := CQRSMarshaler.Marshal(UserRegistered{UserID: uuid.Must(uuid.NewV7())})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := msg.Metadata.Get(SchemaVersionMetadataKey); v != "1" {
+		t.Errorf("expected schema version 1, got %q", v)
+	}
+}
+
+// newTestWatermillHandlers returns the event handlers, sending emails and CRM requests to the gateway.
+func newTestWatermillHandlers(t *testing.T, gatewayAddr string) *WatermillHandlers {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.Gateway.Addr = gatewayAddr
+	config.EmailConfirmation.SigningKey = strings.Repeat("k", minEmailConfirmationKeyLength)
+
+	emailProvider, err := NewEmailProvider(config.Email, config.Gateway)
+	if err != nil {
+		t.Fatal(err)
+	}
+	emailTemplates, err := NewEmailTemplates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &WatermillHandlers{
+		mailer:             NewMailer(emailProvider, emailTemplates),
+		emailConfirmations: NewEmailConfirmations(config.EmailConfirmation),
+		crm:                NewCRMBatcher(nil, NewCRMClient(config.Gateway.Addr, config.Gateway.CRM), config.Gateway.CRMBatch),
+	}
+}
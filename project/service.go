@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/ThreeDotsLabs/watermill/components/forwarder"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/errgroup"
+)
+
+// Service wires together the HTTP API, the outbox forwarder and the event handlers.
+// Everything it talks to is passed in, so the whole user-registration flow can run
+// in one process against an in-memory Pub/Sub and stand-in gateways.
+type Service struct {
+	db              *sqlx.DB
+	pubSub          *PubSub
+	watermillRouter *message.Router
+	echoRouter      *echo.Echo
+	outboxMonitor   *OutboxMonitor
+	outboxCleaner   *OutboxCleaner
+	dedupCleaner    *ProcessedMessagesCleaner
+	crmBatcher      *CRMBatcher
+	emailExpirer    *EmailChangeExpirer
+	outbox          *Outbox
+	forwarder       *forwarder.Forwarder
+	shutdownConfig  ShutdownConfig
+
+	forwarderRunning atomic.Bool
+	// forwarderStarted receives whether the forwarder was started once the service stops waiting for the router.
+	forwarderStarted chan bool
+}
+
+func NewService(
+	config Config,
+	db *sqlx.DB,
+	pubSub *PubSub,
+	outbox *Outbox,
+	mailer *Mailer,
+	crmClient *CRMClient,
+	metricsRegistry *prometheus.Registry,
+) (*Service, error) {
+	poisonQueue, err := NewPoisonQueue(db, newWatermillLogger())
+	if err != nil {
+		return nil, err
+	}
+
+	watermillRouter, err := NewWatermillRouter(pubSub, poisonQueue, config.Retry, config.Shutdown.RouterTimeout, metricsRegistry)
+	if err != nil {
+		return nil, err
+	}
+
+	emailConfirmations := NewEmailConfirmations(config.EmailConfirmation)
+
+	crmBatcher := NewCRMBatcher(db, crmClient, config.Gateway.CRMBatch)
+
+	err = NewWatermillHandlers(watermillRouter, pubSub, NewProcessedMessages(db, config.ProcessedMessages), mailer, emailConfirmations, crmBatcher)
+	if err != nil {
+		return nil, err
+	}
+
+	fwd, err := NewForwarder(db, pubSub, config.Shutdown.ForwarderTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		db:              db,
+		pubSub:          pubSub,
+		watermillRouter: watermillRouter,
+		outboxMonitor:   NewOutboxMonitor(db, config.OutboxMonitor),
+		outboxCleaner:   NewOutboxCleaner(db, config.OutboxCleaner),
+		dedupCleaner:    NewProcessedMessagesCleaner(db, config.ProcessedMessages),
+		crmBatcher:      crmBatcher,
+		emailExpirer:    NewEmailChangeExpirer(db, outbox, config.EmailConfirmation),
+		outbox:          outbox,
+		forwarder:       fwd,
+		shutdownConfig:  config.Shutdown,
+
+		forwarderStarted: make(chan bool, 1),
+	}
+
+	readinessChecks := []HealthCheck{
+		dbHealthCheck(db),
+		pubSubHealthCheck(pubSub),
+		routerHealthCheck(watermillRouter),
+		forwarderHealthCheck(s.forwarderRunning.Load),
+	}
+
+	s.echoRouter = NewHTTPRouter(
+		config.HTTP,
+		db,
+		outbox,
+		poisonQueue,
+		pubSub.Publisher(),
+		metricsRegistry,
+		s.outboxMonitor,
+		readinessChecks,
+		emailConfirmations,
+	)
+
+	return s, nil
+}
+
+func (s *Service) Run(ctx context.Context, httpAddr string) error {
+	slog.Info("Starting service")
+
+	// Components aren't stopped by ctx directly, but in order by shutdown.
+	// errCtx is only cancelled when one of them fails.
+	errgrp, errCtx := errgroup.WithContext(context.WithoutCancel(ctx))
+	backgroundCtx, cancelBackground := context.WithCancel(errCtx)
+	defer cancelBackground()
+
+	errgrp.Go(func() error {
+		return s.watermillRouter.Run(errCtx)
+	})
+
+	errgrp.Go(func() error {
+		// Wait for the Watermill router to be running before starting the HTTP server,
+		// so the service isn't marked as healthy before the handlers are subscribed.
+		if !s.waitForRouter(ctx, errCtx) {
+			return nil
+		}
+
+		err := s.echoRouter.Start(httpAddr)
+
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+
+		return nil
+	})
+
+	errgrp.Go(func() error {
+		// Events are forwarded only once the handlers are subscribed, so none are published before anyone listens.
+		if !s.waitForRouter(ctx, errCtx) {
+			s.forwarderStarted <- false
+			return nil
+		}
+		s.forwarderStarted <- true
+
+		s.forwarderRunning.Store(true)
+		defer s.forwarderRunning.Store(false)
+
+		return s.forwarder.Run(errCtx)
+	})
+
+	errgrp.Go(func() error {
+		return s.outboxMonitor.Run(backgroundCtx)
+	})
+
+	errgrp.Go(func() error {
+		return s.outboxCleaner.Run(backgroundCtx)
+	})
+
+	errgrp.Go(func() error {
+		return s.dedupCleaner.Run(backgroundCtx)
+	})
+
+	errgrp.Go(func() error {
+		return s.emailExpirer.Run(backgroundCtx)
+	})
+
+	errgrp.Go(func() error {
+		return s.crmBatcher.Run(backgroundCtx)
+	})
+
+	errgrp.Go(func() error {
+		select {
+		case <-ctx.Done():
+			slog.Info("Received shutdown signal")
+		case <-errCtx.Done():
+			slog.Warn("Service component failed, shutting down")
+		}
+
+		return s.shutdown(cancelBackground)
+	})
+
+	return errgrp.Wait()
+}
+
+// waitForRouter blocks until the Watermill router is running. It returns false if the service
+// is shut down or a component fails first, in which case nothing should be started anymore.
+// The router may still report running after a shutdown, as Close doesn't stop it from subscribing the handlers.
+func (s *Service) waitForRouter(ctx context.Context, errCtx context.Context) bool {
+	select {
+	case <-s.watermillRouter.Running():
+	case <-ctx.Done():
+	case <-errCtx.Done():
+	}
+
+	return ctx.Err() == nil && errCtx.Err() == nil
+}
+
+// shutdown stops the service in order: it stops accepting HTTP requests and the background workers,
+// waits for in-flight outbox transactions, lets the forwarder finish the message it's forwarding,
+// and then closes the router, letting the event handlers finish.
+func (s *Service) shutdown(stopBackground context.CancelFunc) error {
+	httpErr := runShutdownPhase("http", s.shutdownConfig.HTTPTimeout, s.echoRouter.Shutdown)
+
+	// Background workers like the email change expirer open outbox transactions too.
+	stopBackground()
+
+	return errors.Join(
+		httpErr,
+		runShutdownPhase("outbox transactions", s.shutdownConfig.OutboxTimeout, s.outbox.Wait),
+		runShutdownPhase("forwarder", s.shutdownConfig.ForwarderTimeout, s.closeForwarder),
+		runShutdownPhase("router", s.shutdownConfig.RouterTimeout, closeFunc(s.watermillRouter.Close)),
+	)
+}
+
+// closeForwarder closes the forwarder if it was started. A forwarder that never ran can't be closed,
+// as closing waits for it to stop.
+func (s *Service) closeForwarder(ctx context.Context) error {
+	select {
+	case started := <-s.forwarderStarted:
+		if !started {
+			return nil
+		}
+		return s.forwarder.Close()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Running is closed once the event handlers are subscribed and the HTTP API is about to start.
+func (s *Service) Running() chan struct{} {
+	return s.watermillRouter.Running()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// ShutdownConfig sets a deadline for each shutdown phase, see Service.shutdown.
+type ShutdownConfig struct {
+	HTTPTimeout      time.Duration `yaml:"http_timeout"`
+	OutboxTimeout    time.Duration `yaml:"outbox_timeout"`
+	ForwarderTimeout time.Duration `yaml:"forwarder_timeout"`
+	RouterTimeout    time.Duration `yaml:"router_timeout"`
+}
+
+func DefaultShutdownConfig() ShutdownConfig {
+	return ShutdownConfig{
+		HTTPTimeout:      10 * time.Second,
+		OutboxTimeout:    5 * time.Second,
+		ForwarderTimeout: 10 * time.Second,
+		RouterTimeout:    30 * time.Second,
+	}
+}
+
+// runShutdownPhase runs fn with the phase deadline and logs its progress.
+// fn is left running in the background if it doesn't respect the deadline.
+func runShutdownPhase(name string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	logger := slog.With("phase", name, "timeout", timeout.String())
+	logger.Info("Shutdown phase started")
+
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		logger.With("error", err).Warn("Shutdown phase failed")
+		return fmt.Errorf("shutdown phase %s: %w", name, err)
+	}
+
+	logger.Info("Shutdown phase done", "duration", time.Since(start).String())
+	return nil
+}
+
+// closeFunc adapts a Close method to runShutdownPhase.
+func closeFunc(close func() error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		return close()
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/ThreeDotsLabs/watermill/components/cqrs"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "watermill-course/project"
+
+// Trace context travels between components in message metadata, so a registration can be
+// followed from the HTTP request, through the outbox and the forwarder, to each event handler.
+var tracePropagator = propagation.TraceContext{}
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// NewTracerProvider exports spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT is set.
+// Otherwise spans are recorded but not exported.
+func NewTracerProvider(ctx context.Context) (*sdktrace.TracerProvider, error) {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("project"),
+		)),
+	}
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		exporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+
+	return sdktrace.NewTracerProvider(opts...), nil
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func injectTraceContext(ctx context.Context, msg *message.Message) {
+	tracePropagator.Inject(ctx, propagation.MapCarrier(msg.Metadata))
+}
+
+func extractTraceContext(ctx context.Context, msg *message.Message) context.Context {
+	return tracePropagator.Extract(ctx, propagation.MapCarrier(msg.Metadata))
+}
+
+// echoTracingMiddleware starts a server span for each HTTP request.
+func echoTracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := tracePropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+		ctx, span := tracer().Start(
+			ctx,
+			req.Method+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(req.Method),
+				semconv.HTTPRoute(c.Path()),
+			),
+		)
+		c.SetRequest(req.WithContext(ctx))
+
+		err := next(c)
+
+		status := responseStatus(c, err)
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		span.End()
+
+		return err
+	}
+}
+
+// injectTraceContextOnPublish is used as cqrs.EventBusConfig.OnPublish.
+func injectTraceContextOnPublish(params cqrs.OnEventSendParams) error {
+	injectTraceContext(params.Message.Context(), params.Message)
+	return nil
+}
+
+// tracingMiddleware starts a consumer span for each handled message, as a child of the span
+// that published it. The message metadata is updated, so messages republished by the handler
+// (like in the splitter) continue the trace from this span.
+func tracingMiddleware(h message.HandlerFunc) message.HandlerFunc {
+	return func(msg *message.Message) (events []*message.Message, err error) {
+		handlerName := message.HandlerNameFromCtx(msg.Context())
+
+		ctx, span := tracer().Start(
+			extractTraceContext(msg.Context(), msg),
+			"handle "+handlerName,
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				attribute.String("messaging.handler", handlerName),
+				attribute.String("messaging.source", message.SubscribeTopicFromCtx(msg.Context())),
+				attribute.String("messaging.message.id", msg.UUID),
+			),
+		)
+		defer func() {
+			endSpan(span, err)
+		}()
+
+		msg.SetContext(ctx)
+		injectTraceContext(ctx, msg)
+
+		return h(msg)
+	}
+}
+
+// tracingPublisher wraps the publisher used by the forwarder, adding a span for the hop
+// from the outbox table to the Pub/Sub.
+type tracingPublisher struct {
+	message.Publisher
+	spanName string
+}
+
+func (p tracingPublisher) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		ctx, span := tracer().Start(
+			extractTraceContext(msg.Context(), msg),
+			p.spanName,
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(
+				attribute.String("messaging.destination", topic),
+				attribute.String("messaging.message.id", msg.UUID),
+			),
+		)
+		injectTraceContext(ctx, msg)
+
+		err := p.Publisher.Publish(topic, msg)
+		endSpan(span, err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// injectTraceHeaders passes the trace context to the gateway.
+func injectTraceHeaders(ctx context.Context, req *http.Request) {
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing_RegisterUser(t *testing.T) {
+	spanRecorder := tracetest.NewSpanRecorder()
+	previousTracerProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previousTracerProvider) })
+
+	s := newTestService(t)
+	s.registerUser(t, "Test User", "user-"+randomHex(t, 4)+"@example.com")
+
+	var handlerSpan sdktrace.ReadOnlySpan
+	waitFor(t, 10*time.Second, "SendWelcomeEmail span", func() bool {
+		for _, span := range spanRecorder.Ended() {
+			if span.Name() == "handle SendWelcomeEmail" {
+				handlerSpan = span
+				return true
+			}
+		}
+		return false
+	})
+
+	spansByID := map[trace.SpanID]sdktrace.ReadOnlySpan{}
+	for _, span := range spanRecorder.Ended() {
+		spansByID[span.SpanContext().SpanID()] = span
+	}
+
+	var chain []string
+	for span, ok := handlerSpan, true; ok; span, ok = spansByID[span.Parent().SpanID()] {
+		chain = append(chain, span.Name())
+
+		if span.SpanContext().TraceID() != handlerSpan.SpanContext().TraceID() {
+			t.Errorf("span %s is in another trace", span.Name())
+		}
+	}
+
+	expected := []string{
+		"handle SendWelcomeEmail",
+		"handle event-handler",
+		"forwarder.forward",
+		"outbox.publish",
+		"UpdateInTx",
+		"POST /users",
+	}
+	if !slices.Equal(chain, expected) {
+		t.Errorf("unexpected span chain, from the handler up to the root:\n got: %v\nwant: %v", chain, expected)
+	}
+}
+
+func TestEchoTracingMiddleware_status(t *testing.T) {
+	spanRecorder := tracetest.NewSpanRecorder()
+	previousTracerProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previousTracerProvider) })
+
+	testCases := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantError  bool
+	}{
+		{name: "ok", wantStatus: http.StatusOK},
+		{name: "app_error", err: NewConflictError("email_taken", "email address is already registered"), wantStatus: http.StatusConflict},
+		{name: "echo_error", err: echo.ErrNotFound, wantStatus: http.StatusNotFound},
+		{name: "unknown_error", err: errors.New("connection refused"), wantStatus: http.StatusInternalServerError, wantError: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spanRecorder.Reset()
+
+			var errorHandlerCalls int
+			e := echo.New()
+			e.HTTPErrorHandler = func(err error, c echo.Context) {
+				errorHandlerCalls++
+				echoErrorHandler(err, c)
+			}
+			// Chained like in useEchoMiddleware, with an inner middleware that also returns the error.
+			e.Use(echoTracingMiddleware, echoMetricsMiddleware)
+			e.GET("/test", func(c echo.Context) error {
+				if tc.err != nil {
+					return tc.err
+				}
+				return c.NoContent(http.StatusOK)
+			})
+
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/test", nil))
+
+			if rec.Code != tc.wantStatus {
+				t.Errorf("expected status %d, got %d", tc.wantStatus, rec.Code)
+			}
+			wantCalls := 0
+			if tc.err != nil {
+				wantCalls = 1
+			}
+			if errorHandlerCalls != wantCalls {
+				t.Errorf("expected the error handler to be called %d times, got %d", wantCalls, errorHandlerCalls)
+			}
+
+			spans := spanRecorder.Ended()
+			if len(spans) != 1 {
+				t.Fatalf("expected 1 span, got %d", len(spans))
+			}
+			var status attribute.Value
+			for _, attr := range spans[0].Attributes() {
+				if attr.Key == semconv.HTTPResponseStatusCodeKey {
+					status = attr.Value
+				}
+			}
+			if status.AsInt64() != int64(tc.wantStatus) {
+				t.Errorf("expected the span to have status %d, got %v", tc.wantStatus, status.Emit())
+			}
+			if isError := spans[0].Status().Code == codes.Error; isError != tc.wantError {
+				t.Errorf("expected the span error status %v, got %v", tc.wantError, spans[0].Status())
+			}
+		})
+	}
+}
@@ -4,7 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
-	"os"
+	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/ThreeDotsLabs/watermill"
@@ -12,38 +12,35 @@ import (
 	"github.com/ThreeDotsLabs/watermill/components/cqrs"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const topic = "events"
 
-func NewWatermillRouter() (*message.Router, error) {
+func NewWatermillRouter(
+	pubSub *PubSub,
+	poisonQueue *PoisonQueue,
+	retryConfigs HandlerRetryConfigs,
+	closeTimeout time.Duration,
+	metricsRegistry prometheus.Registerer,
+) (*message.Router, error) {
 	logger := newWatermillLogger()
 
-	router, err := message.NewRouter(message.RouterConfig{}, logger)
+	// On Close, handlers get closeTimeout to finish the messages they are handling.
+	router, err := message.NewRouter(message.RouterConfig{CloseTimeout: closeTimeout}, logger)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create router: %w", err)
 	}
 
-	pub, err := kafka.NewPublisher(kafka.PublisherConfig{
-		Brokers: []string{os.Getenv("KAFKA_ADDR")},
-		Marshaler: KafkaMarshaler,
-	}, logger)
+	pub := pubSub.Publisher()
 
-	if err != nil {
-		return nil, fmt.Errorf("error starting the publisher: %w", err)
-	}
-
-	sub, err := kafka.NewSubscriber(kafka.SubscriberConfig{
-		OverwriteSaramaConfig: newSubscriberSaramaConfig(),
-		Brokers: []string{os.Getenv("KAFKA_ADDR")},
-		Unmarshaler: KafkaMarshaler,
-		ConsumerGroup: "splitter",
-	}, logger)
-	
+	sub, err := pubSub.Subscriber("splitter")
 	if err != nil {
 		return nil, fmt.Errorf("error starting the subscriber: %w", err)
 	}
 
+	addRouterMetrics(router, metricsRegistry)
+
 	router.AddConsumerHandler(
 		"event-handler",
 		topic,
@@ -54,12 +51,27 @@ func NewWatermillRouter() (*message.Router, error) {
 		},
 	)
 
+	poisonQueueMiddleware, err := poisonQueue.Middleware()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create poison queue middleware: %w", err)
+	}
+
+	// Middlewares run in the order they are added, so the poison queue only sees
+	// errors that are left after all retries.
+	router.AddMiddleware(poisonQueueMiddleware)
+
+	router.AddMiddleware(
+		correlationIDMiddleware,
+		tracingMiddleware,
+	)
+
 	router.AddMiddleware(func(h message.HandlerFunc) message.HandlerFunc {
 		return func(msg *message.Message) ([]*message.Message, error) {
 			eventName := CQRSMarshaler.NameFromMessage(msg)
 			handlerName := message.HandlerNameFromCtx(msg.Context())
 
-			slog.Info(
+			slog.InfoContext(
+				msg.Context(),
 				"Received event",
 				"name", eventName,
 				"handler", handlerName,
@@ -73,19 +85,26 @@ func NewWatermillRouter() (*message.Router, error) {
 	// https://watermill.io/docs/messages-router/#middleware
 	//
 	// List of available middlewares you can find in message/router/middleware.
-	router.AddMiddleware(middleware.Recoverer)
+	router.AddMiddleware(
+		retryConfigs.Middleware(logger),
+		middleware.Recoverer,
+	)
 
 	return router, nil
 }
 
 func NewWatermillHandlers(
 	router *message.Router,
-	sender EmailSender,
-	crm CRMClient,
+	pubSub *PubSub,
+	processedMessages *ProcessedMessages,
+	mailer *Mailer,
+	emailConfirmations *EmailConfirmations,
+	crm *CRMBatcher,
 ) error {
 	h := &WatermillHandlers{
-		emailSender: sender,
-		crmClient:   crm,
+		mailer:             mailer,
+		emailConfirmations: emailConfirmations,
+		crm:                crm,
 	}
 
 	logger := newWatermillLogger()
@@ -97,16 +116,9 @@ func NewWatermillHandlers(
 				return params.EventName, nil
 			},
 			SubscriberConstructor: func(params cqrs.EventProcessorSubscriberConstructorParams) (message.Subscriber, error) {
-				return kafka.NewSubscriber(
-					kafka.SubscriberConfig{
-						OverwriteSaramaConfig: newSubscriberSaramaConfig(),
-						Brokers:               []string{os.Getenv("KAFKA_ADDR")},
-						Unmarshaler:           KafkaMarshaler,
-						ConsumerGroup:         params.HandlerName,
-					},
-					logger,
-				)
+				return pubSub.Subscriber(params.HandlerName)
 			},
+			OnHandle:  processedMessages.OnHandle,
 			Marshaler: CQRSMarshaler,
 			Logger:    logger,
 		},
@@ -115,70 +127,71 @@ func NewWatermillHandlers(
 		return fmt.Errorf("failed to create event processor: %w", err)
 	}
 
-	return eventProcessor.AddHandlers(
-		cqrs.NewEventHandler("SendWelcomeEmail", h.SendWelcomeEmail),
-		cqrs.NewEventHandler("ConfirmEmailChange", h.ConfirmEmailChange),
-		cqrs.NewEventHandler("AddToCRM", h.AddToCRM),
-		cqrs.NewEventHandler("NotifyEmailChange", h.NotifyEmailChange),
-	)
+	return eventProcessor.AddHandlers(h.EventHandlers()...)
 }
 
 type WatermillHandlers struct {
-	emailSender EmailSender
-	crmClient   CRMClient
+	mailer             *Mailer
+	emailConfirmations *EmailConfirmations
+	crm                *CRMBatcher
 }
 
-func (h *WatermillHandlers) SendWelcomeEmail(ctx context.Context, event *UserRegistered) error {
-	return h.emailSender.SendEmail(
-		ctx,
-		event.Email,
-		"Welcome to our website!",
-		fmt.Sprintf("Hello %s,\n\nThank you for registering!", event.Name),
-	)
+// EventHandlers returns all event handlers, by the names used as their consumer groups.
+func (h *WatermillHandlers) EventHandlers() []cqrs.EventHandler {
+	return []cqrs.EventHandler{
+		Idempotent(cqrs.NewEventHandler("SendWelcomeEmail", h.SendWelcomeEmail)),
+		Idempotent(cqrs.NewEventHandler("ConfirmEmailChange", h.ConfirmEmailChange)),
+		Idempotent(cqrs.NewEventHandler("AddToCRM", h.AddToCRM)),
+		Idempotent(cqrs.NewEventHandler("NotifyConfirmedEmailChange", h.NotifyEmailChange)),
+		// Keeps the name the handler had before email changes were confirmed, so it continues
+		// from the same offsets and processed messages instead of notifying about old changes again.
+		Idempotent(cqrs.NewEventHandler("NotifyEmailChange", h.NotifyLegacyEmailChange)),
+	}
 }
 
-func (h *WatermillHandlers) ConfirmEmailChange(ctx context.Context, event *UserEmailUpdated) error {
-	return h.emailSender.SendEmail(
-		ctx,
-		event.NewEmail,
-		"Confirm your new email address",
-		"Hello,\n\nPlease confirm this is your new email address.",
-	)
+func (h *WatermillHandlers) SendWelcomeEmail(ctx context.Context, event *UserRegistered) error {
+	return h.mailer.Send(ctx, EmailWelcome, event.Locale, event.Email, WelcomeEmailData{
+		Name: event.Name,
+	})
 }
 
-func (h *WatermillHandlers) NotifyEmailChange(ctx context.Context, event *UserEmailUpdated) error {
-	return h.emailSender.SendEmail(
-		ctx,
-		event.OldEmail,
-		"Your email is updated",
-		"Hello, Your email is modified to " + event.NewEmail,
-	)
+func (h *WatermillHandlers) ConfirmEmailChange(ctx context.Context, event *UserEmailChangeRequested) error {
+	return h.mailer.Send(ctx, EmailConfirmEmailChange, event.Locale, event.NewEmail, ConfirmEmailChangeData{
+		ConfirmURL: h.emailConfirmations.Link(event.UserID, event.ChangeID, event.ExpiresAt),
+		ExpiresAt:  event.ExpiresAt,
+	})
 }
 
-func (h *WatermillHandlers) AddToCRM(ctx context.Context, event *UserRegistered) error {
-	return h.crmClient.SendUserToCRM(ctx, event.UserID, event.Name, event.Email)
+func (h *WatermillHandlers) NotifyEmailChange(ctx context.Context, event *UserEmailConfirmed) error {
+	return h.mailer.Send(ctx, EmailNotifyEmailChange, event.Locale, event.OldEmail, NotifyEmailChangeData{
+		NewEmail: event.NewEmail,
+	})
 }
 
-func NewEventBus() (*cqrs.EventBus, error) {
-	logger := newWatermillLogger()
+// NotifyLegacyEmailChange handles changes made before they had to be confirmed.
+// They were already applied, so there is nothing to confirm and only the old address is notified.
+func (h *WatermillHandlers) NotifyLegacyEmailChange(ctx context.Context, event *UserEmailUpdated) error {
+	return h.mailer.Send(ctx, EmailNotifyEmailChange, event.Locale, event.OldEmail, NotifyEmailChangeData{
+		NewEmail: event.NewEmail,
+	})
+}
 
-	pub, err := kafka.NewPublisher(
-		kafka.PublisherConfig{
-			Brokers:   []string{os.Getenv("KAFKA_ADDR")},
-			Marshaler: KafkaMarshaler,
-		},
-		logger,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create kafka publisher: %w", err)
-	}
+func (h *WatermillHandlers) AddToCRM(ctx context.Context, event *UserRegistered) error {
+	return h.crm.AddUser(ctx, SendUserToCRMRequest{
+		UserID: event.UserID,
+		Name:   event.Name,
+		Email:  event.Email,
+	})
+}
 
+func NewEventBus(pubSub *PubSub) (*cqrs.EventBus, error) {
 	eventBus, err := cqrs.NewEventBusWithConfig(
-		pub,
+		pubSub.Publisher(),
 		cqrs.EventBusConfig{
 			GeneratePublishTopic: func(params cqrs.GenerateEventPublishTopicParams) (string, error) {
 				return topic, nil
 			},
+			OnPublish: onEventPublish,
 			Marshaler: CQRSMarshaler,
 		},
 	)
@@ -200,24 +213,36 @@ func GenerateKafkaPartitionKey(topic string, msg *message.Message) (string, erro
 var KafkaMarshaler = kafka.NewWithPartitioningMarshaler(GenerateKafkaPartitionKey)
 
 // This marshaler converts events to Watermill messages and vice versa.
-var CQRSMarshaler = cqrs.CommandEventMarshalerDecorator {
-	CommandEventMarshaler: cqrs.JSONMarshaler{
-		GenerateName: cqrs.StructName,
-	},
-	DecorateFunc: func(v any, msg *message.Message) error {
-		pm, ok := v.(Event)
-		if !ok {
-			return fmt.Errorf("%v can't be marshaled, it does not implement Event", v)
-		}
-		pk := pm.PartitionKey()
-		if pk == "" {
-			return fmt.Errorf("partition key is empty")
-		}
-		msg.Metadata.Set(PartionKeyMetadataField, pk)
-		return nil
+// Payloads of older schema versions are upcast before unmarshaling, see eventSchemas.
+var CQRSMarshaler = versionedMarshaler{
+	CommandEventMarshaler: cqrs.CommandEventMarshalerDecorator{
+		CommandEventMarshaler: cqrs.JSONMarshaler{
+			GenerateName: cqrs.StructName,
+		},
+		DecorateFunc: func(v any, msg *message.Message) error {
+			pm, ok := v.(Event)
+			if !ok {
+				return fmt.Errorf("%v can't be marshaled, it does not implement Event", v)
+			}
+			pk := pm.PartitionKey()
+			if pk == "" {
+				return fmt.Errorf("partition key is empty")
+			}
+			msg.Metadata.Set(PartionKeyMetadataField, pk)
+			return nil
+		},
 	},
 }
 
+// onEventPublish is used as cqrs.EventBusConfig.OnPublish, to pass the correlation ID
+// and the trace context from the publisher's context to the message metadata.
+func onEventPublish(params cqrs.OnEventSendParams) error {
+	if err := setCorrelationIDOnPublish(params); err != nil {
+		return err
+	}
+	return injectTraceContextOnPublish(params)
+}
+
 func newSubscriberSaramaConfig() *sarama.Config {
 	cfg := kafka.DefaultSaramaSubscriberConfig()
 	// We want to start consuming from the oldest message on the first run.